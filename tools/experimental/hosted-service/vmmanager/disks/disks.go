@@ -20,13 +20,17 @@ package disks
 import (
 	"crypto/sha256"
 	"encoding/base32"
+	"encoding/binary"
 	"fmt"
 	"log"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
 	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
 
 	"vm-manager/utils"
 )
@@ -38,6 +42,49 @@ const (
 	diskStatusReady     = "READY"
 )
 
+// RetryPolicy controls how a Manager retries transient Compute Engine API
+// errors (e.g. 5xxs or 429s) when checking whether a user's disk exists.
+type RetryPolicy struct {
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff time.Duration
+
+	// Multiplier scales the backoff delay after each retry.
+	Multiplier float64
+
+	// MaxAttempts is the maximum number of times to call the API,
+	// including the initial attempt.
+	MaxAttempts int
+}
+
+// defaultRetryPolicy is used by Managers created with a nil RetryPolicy.
+var defaultRetryPolicy = RetryPolicy{
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Multiplier:     2,
+	MaxAttempts:    5,
+}
+
+// isNotFoundError reports whether err is a Compute Engine API error
+// indicating that the requested resource does not exist.
+func isNotFoundError(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == http.StatusNotFound
+}
+
+// isRetryableError reports whether err is a transient Compute Engine API
+// error (a 5xx or a 429) worth retrying, as opposed to a permanent failure
+// such as an auth or quota problem.
+func isRetryableError(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500
+}
+
 // A Manager provides functionality for getting the disk for a user.
 //
 // The Manager maintains a 1:1 mapping between user's a disks, so that
@@ -53,11 +100,56 @@ const (
 type Manager struct {
 	svc            *compute.Service
 	project        string
-	zone           string
 	sourceSnapshot string
+
+	// zones is the ranked list of zones healthy disks may be created in.
+	// A user's disk is placed in one of these zones, chosen by hashing
+	// their email, with fallback to the other zones, in their listed
+	// order, on a zonal stockout.
+	zones []string
+
+	// userZonesMu guards userZones.
+	userZonesMu sync.Mutex
+
+	// userZones records the zone actually used for a user's disk, once
+	// known, so that later calls land in the same zone even if it
+	// differs from the hash-selected zone (e.g. due to a past fallback).
+	userZones map[string]string
+
+	// sourceSnapshotKey is the Cloud KMS key (if any) that was used to
+	// encrypt sourceSnapshot. It must be supplied whenever a new disk is
+	// created from that snapshot, so that the snapshot can be decrypted.
+	sourceSnapshotKey *compute.CustomerEncryptionKey
+
+	// keyForUser selects the Cloud KMS key that should be used to encrypt
+	// the disk created for a given user. It may be nil, in which case
+	// user disks are protected by the default Google-managed key. It may
+	// also return nil for a given user for the same reason.
+	keyForUser func(userEmail string) *compute.CustomerEncryptionKey
+
+	// diskType is the default disk type (e.g. "pd-standard", "pd-ssd",
+	// "pd-balanced") used for newly created user disks.
+	diskType string
+
+	// diskSizeGB is the default size, in GB, used for newly created user
+	// disks. This is independent of the size of the template disk that
+	// sourceSnapshot was generated from; disks are resized up to this
+	// size after being restored from the snapshot.
+	diskSizeGB int64
+
+	// diskParamsForUser, if non-nil, is called for every disk created (or
+	// resized) by the returned Manager in order to select the disk type
+	// and size that should be granted to a particular user, e.g. so that
+	// premium storage can be granted to specific users. A zero-valued
+	// return for either field falls back to diskType/diskSizeGB.
+	diskParamsForUser func(userEmail string) (diskType string, sizeGB int64)
+
+	// retryPolicy governs how transient errors from Disks.Get are retried
+	// when checking whether a user's disk already exists.
+	retryPolicy RetryPolicy
 }
 
-func createSourceSnapshot(ctx context.Context, svc *compute.Service, project, zone, snapshotName, diskInitScript string, sizeGB int64, vmNetwork string) (*compute.Snapshot, error) {
+func createSourceSnapshot(ctx context.Context, svc *compute.Service, project, zone, snapshotName, diskInitScript string, sizeGB int64, vmNetwork string, templateKey *compute.CustomerEncryptionKey) (*compute.Snapshot, error) {
 	startupScript := `#!/bin/bash
 
 PERSISTENT_DISK_DEV="/dev/disk/by-id/google-user-pd"
@@ -110,9 +202,10 @@ shutdown -P now
 	diskName := "template-disk-" + poolTimeStampString
 	diskAPIPath := "projects/" + project + "/zones/" + zone + "/disks/" + diskName
 	diskOp, err := svc.Disks.Insert(project, zone, &compute.Disk{
-		Description: "Template disk",
-		Name:        diskName,
-		SizeGb:      sizeGB,
+		Description:       "Template disk",
+		Name:              diskName,
+		SizeGb:            sizeGB,
+		DiskEncryptionKey: templateKey,
 	}).Do()
 	if err != nil {
 		return nil, err
@@ -128,7 +221,7 @@ shutdown -P now
 		"startup-script":   &startupScript,
 		"disk-init-script": &diskInitScript,
 	}
-	if err := utils.CreateVM(svc, project, zone, instanceName, instanceDescription, "f1-micro", vmNetwork, "", 10, metadata, pollingInterval); err != nil {
+	if err := utils.CreateVM(svc, project, zone, instanceName, instanceDescription, "f1-micro", utils.NetworkConfig{Network: vmNetwork}, "", 10, nil, metadata, pollingInterval); err != nil {
 		return nil, err
 	}
 	defer svc.Instances.Delete(project, zone, instanceName).Do()
@@ -156,8 +249,10 @@ shutdown -P now
 		}
 		if instance.Status == "TERMINATED" {
 			snapshotOp, err := svc.Disks.CreateSnapshot(project, zone, diskName, &compute.Snapshot{
-				Description: "Starting snapshot for user disks",
-				Name:        snapshotName,
+				Description:             "Starting snapshot for user disks",
+				Name:                    snapshotName,
+				SnapshotEncryptionKey:   templateKey,
+				SourceDiskEncryptionKey: templateKey,
 			}).Do()
 			if err != nil {
 				return nil, err
@@ -171,13 +266,13 @@ shutdown -P now
 	}
 }
 
-func getOrCreateSnapshot(ctx context.Context, computeService *compute.Service, project, zone, snapshotName, diskInitScript string, sizeGB int64, vmNetwork string) (*compute.Snapshot, error) {
+func getOrCreateSnapshot(ctx context.Context, computeService *compute.Service, project, zone, snapshotName, diskInitScript string, sizeGB int64, vmNetwork string, templateKey *compute.CustomerEncryptionKey) (*compute.Snapshot, error) {
 	snapshot, err := computeService.Snapshots.Get(project, snapshotName).Do()
 	if err == nil {
 		return snapshot, nil
 	}
 
-	return createSourceSnapshot(ctx, computeService, project, zone, snapshotName, diskInitScript, sizeGB, vmNetwork)
+	return createSourceSnapshot(ctx, computeService, project, zone, snapshotName, diskInitScript, sizeGB, vmNetwork, templateKey)
 }
 
 // NewManager creates a new Manager in the given project/zone combination.
@@ -199,22 +294,125 @@ func getOrCreateSnapshot(ctx context.Context, computeService *compute.Service, p
 // The `vmNetwork` parameter is used to specify the name of the network in which
 // the disk-formatting VM will reside. This VM does not need to accept inbound
 // connections, so you should provide the most locked-down network you have.
-func NewManager(ctx context.Context, computeService *compute.Service, project, zone, snapshotName, diskInitScript string, sizeGB int64, vmNetwork string) (*Manager, error) {
-	log.Printf("Creating the source snapshot for user disks in %q/%q", project, zone)
-	snapshot, err := getOrCreateSnapshot(ctx, computeService, project, zone, snapshotName, diskInitScript, sizeGB, vmNetwork)
+//
+// The `templateKey` parameter, if non-nil, is the Cloud KMS key used to
+// encrypt the source snapshot (and the disk it is generated from). It may
+// be left nil to use the default Google-managed encryption.
+//
+// The `keyForUser` parameter, if non-nil, is called for every disk created
+// by the returned Manager in order to select the Cloud KMS key that should
+// protect that particular user's disk. This allows different tenants to be
+// encrypted with different keys. It may be left nil (or may itself return
+// nil for a given user) to fall back to the default Google-managed
+// encryption for that disk.
+//
+// The `diskType` and `diskSizeGB` parameters specify the default disk type
+// (e.g. "pd-standard", "pd-ssd", "pd-balanced") and size, in GB, used for
+// newly created user disks; `diskSizeGB` may be larger than the template
+// disk's own size, in which case restored disks are resized up to it.
+//
+// The `diskParamsForUser` parameter, if non-nil, overrides those defaults
+// on a per-user basis, e.g. to grant premium storage to specific users.
+//
+// The `zones` parameter lists the zones that user disks may be created in.
+// A disk's zone is chosen by hashing the owning user's email (the same
+// hash used by GetDiskName), so a given user is consistently routed to the
+// same zone; if that zone runs out of disk capacity, the Manager falls
+// back to the other zones, in their listed order. The template snapshot used to seed
+// new disks is created in `zones[0]`.
+//
+// The `retryPolicy` parameter, if non-nil, overrides how transient errors
+// (5xxs and 429s) from the Compute Engine API are retried while checking
+// whether a user's disk already exists. It may be left nil to use sensible
+// defaults.
+func NewManager(ctx context.Context, computeService *compute.Service, project string, zones []string, snapshotName, diskInitScript string, sizeGB int64, vmNetwork string, templateKey *compute.CustomerEncryptionKey, keyForUser func(userEmail string) *compute.CustomerEncryptionKey, diskType string, diskSizeGB int64, diskParamsForUser func(userEmail string) (diskType string, sizeGB int64), retryPolicy *RetryPolicy) (*Manager, error) {
+	if len(zones) == 0 {
+		return nil, fmt.Errorf("at least one zone must be provided")
+	}
+
+	policy := defaultRetryPolicy
+	if retryPolicy != nil {
+		policy = *retryPolicy
+	}
+
+	templateZone := zones[0]
+	log.Printf("Creating the source snapshot for user disks in %q/%q", project, templateZone)
+	snapshot, err := getOrCreateSnapshot(ctx, computeService, project, templateZone, snapshotName, diskInitScript, sizeGB, vmNetwork, templateKey)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("Finished creating the disk pool in %q/%q", project, zone)
+	log.Printf("Finished creating the disk pool in %q across zones %v", project, zones)
 	return &Manager{
-		svc:            computeService,
-		project:        project,
-		zone:           zone,
-		sourceSnapshot: snapshot.SelfLink,
+		svc:               computeService,
+		project:           project,
+		zones:             zones,
+		sourceSnapshot:    snapshot.SelfLink,
+		sourceSnapshotKey: templateKey,
+		keyForUser:        keyForUser,
+		diskType:          diskType,
+		diskSizeGB:        diskSizeGB,
+		diskParamsForUser: diskParamsForUser,
+		userZones:         make(map[string]string),
+		retryPolicy:       policy,
 	}, nil
 }
 
+// zoneForUser returns the zone that the given user's disk should live in,
+// preferring a previously-recorded zone (e.g. from a past zonal fallback)
+// and otherwise falling back to a hash of their email.
+func (d *Manager) zoneForUser(userEmail string) string {
+	d.userZonesMu.Lock()
+	zone, ok := d.userZones[userEmail]
+	d.userZonesMu.Unlock()
+	if ok {
+		return zone
+	}
+
+	hash := sha256.Sum256([]byte(userEmail))
+	index := binary.BigEndian.Uint64(hash[:8]) % uint64(len(d.zones))
+	return d.zones[index]
+}
+
+// rememberZone records that the given user's disk lives in zone, so that
+// future calls for that user are routed there directly.
+func (d *Manager) rememberZone(userEmail, zone string) {
+	d.userZonesMu.Lock()
+	defer d.userZonesMu.Unlock()
+	d.userZones[userEmail] = zone
+}
+
+// zoneOrder returns the configured zones, ranked starting at preferred and
+// then the remaining zones in their configured order. This
+// is the order in which zones are tried when a disk needs to be created.
+func (d *Manager) zoneOrder(preferred string) []string {
+	order := make([]string, 0, len(d.zones))
+	order = append(order, preferred)
+	for _, zone := range d.zones {
+		if zone != preferred {
+			order = append(order, zone)
+		}
+	}
+	return order
+}
+
+// diskParamsFor returns the disk type and size that should be used for the
+// given user, falling back to the Manager's defaults.
+func (d *Manager) diskParamsFor(userEmail string) (string, int64) {
+	diskType, sizeGB := d.diskType, d.diskSizeGB
+	if d.diskParamsForUser != nil {
+		if userDiskType, userSizeGB := d.diskParamsForUser(userEmail); userDiskType != "" || userSizeGB != 0 {
+			if userDiskType != "" {
+				diskType = userDiskType
+			}
+			if userSizeGB != 0 {
+				sizeGB = userSizeGB
+			}
+		}
+	}
+	return diskType, sizeGB
+}
+
 // GetDiskName returns the name of the persistent disk for the given user.
 //
 // This does not imply that the specified disk exists, only what the
@@ -237,8 +435,9 @@ func NewManager(ctx context.Context, computeService *compute.Service, project, z
 // name does not start or end with a number.
 //
 // Example:
-//   User Email: user@example.com
-//   Disk Name: user-mj4q529i7cgq071uig7ha3lpn32k4m3v3avths71pgfvoni7aka0-disk
+//
+//	User Email: user@example.com
+//	Disk Name: user-mj4q529i7cgq071uig7ha3lpn32k4m3v3avths71pgfvoni7aka0-disk
 func (d *Manager) GetDiskName(userEmail string) string {
 	hash := sha256.Sum256([]byte(userEmail))
 	base32Str := base32.HexEncoding.EncodeToString(hash[:])
@@ -246,28 +445,68 @@ func (d *Manager) GetDiskName(userEmail string) string {
 	return fmt.Sprintf("user-%s-disk", resourceNamePart)
 }
 
-func (d *Manager) createNewDisk(ctx context.Context, diskName string) (*compute.Disk, error) {
-	disk := &compute.Disk{
-		Name:           diskName,
-		Description:    "Allocated disk for a single user",
-		SourceSnapshot: d.sourceSnapshot,
+// createNewDisk creates diskName, trying each of the Manager's zones in
+// turn (starting with preferredZone) until one succeeds. This allows it to
+// route around a zonal stockout of the requested disk type.
+func (d *Manager) createNewDisk(ctx context.Context, diskName, preferredZone string, userKey *compute.CustomerEncryptionKey, diskType string, sizeGB int64) (*compute.Disk, string, error) {
+	var lastErr error
+	for _, zone := range d.zoneOrder(preferredZone) {
+		disk := &compute.Disk{
+			Name:                        diskName,
+			Description:                 "Allocated disk for a single user",
+			SourceSnapshot:              d.sourceSnapshot,
+			SourceSnapshotEncryptionKey: d.sourceSnapshotKey,
+			DiskEncryptionKey:           userKey,
+			SizeGb:                      sizeGB,
+		}
+		if diskType != "" {
+			disk.Type = "zones/" + zone + "/diskTypes/" + diskType
+		}
+		op, err := d.svc.Disks.Insert(d.project, zone, disk).Do()
+		if err != nil {
+			if utils.IsStockoutError(err) {
+				log.Printf("Zone %q is out of capacity for the disk %q, trying the next zone", zone, diskName)
+				lastErr = err
+				continue
+			}
+			return nil, "", err
+		}
+		if err := utils.WaitForZoneOperation(d.svc, d.project, zone, op.Name, pollingInterval); err != nil {
+			return nil, "", err
+		}
+		disk, err = d.svc.Disks.Get(d.project, zone, diskName).Do()
+		return disk, zone, err
 	}
-	op, err := d.svc.Disks.Insert(d.project, d.zone, disk).Do()
+	return nil, "", fmt.Errorf("failed to create the disk %q in any zone: %v", diskName, lastErr)
+}
+
+// resizeDiskIfNeeded grows disk to sizeGB if it is currently smaller.
+//
+// Persistent disks can only be grown, never shrunk, so a requested size
+// smaller than the disk's current size is silently ignored.
+func (d *Manager) resizeDiskIfNeeded(disk *compute.Disk, zone string, sizeGB int64) (*compute.Disk, error) {
+	if sizeGB <= disk.SizeGb {
+		return disk, nil
+	}
+	log.Printf("Resizing the disk %q from %d GB to %d GB", disk.Name, disk.SizeGb, sizeGB)
+	op, err := d.svc.Disks.Resize(d.project, zone, disk.Name, &compute.DisksResizeRequest{
+		SizeGb: sizeGB,
+	}).Do()
 	if err != nil {
 		return nil, err
 	}
-	if err := utils.WaitForZoneOperation(d.svc, d.project, d.zone, op.Name, pollingInterval); err != nil {
+	if err := utils.WaitForZoneOperation(d.svc, d.project, zone, op.Name, pollingInterval); err != nil {
 		return nil, err
 	}
-	return d.svc.Disks.Get(d.project, d.zone, diskName).Do()
+	return d.svc.Disks.Get(d.project, zone, disk.Name).Do()
 }
 
-func (d *Manager) waitForDiskFinishedCreating(disk *compute.Disk) (*compute.Disk, error) {
+func (d *Manager) waitForDiskFinishedCreating(disk *compute.Disk, zone string) (*compute.Disk, error) {
 	var err error
 	for disk.Status == diskStatusCreating || disk.Status == diskStatusRestoring {
 		time.Sleep(pollingInterval)
 
-		disk, err = d.svc.Disks.Get(d.project, d.zone, disk.Name).Do()
+		disk, err = d.svc.Disks.Get(d.project, zone, disk.Name).Do()
 		if err != nil {
 			return nil, err
 		}
@@ -275,31 +514,280 @@ func (d *Manager) waitForDiskFinishedCreating(disk *compute.Disk) (*compute.Disk
 	return disk, err
 }
 
+// getDisk fetches diskName in the given zone, retrying transient errors
+// (5xxs and 429s) with exponential backoff governed by d.retryPolicy. A 404
+// is returned to the caller immediately, as are any other non-retryable
+// errors (e.g. auth or quota problems), so that callers can tell "does not
+// exist" apart from "could not check".
+func (d *Manager) getDisk(ctx context.Context, zone, diskName string) (*compute.Disk, error) {
+	backoff := d.retryPolicy.InitialBackoff
+	var lastErr error
+	for attempt := 0; attempt < d.retryPolicy.MaxAttempts; attempt++ {
+		disk, err := d.svc.Disks.Get(d.project, zone, diskName).Do()
+		if err == nil {
+			return disk, nil
+		}
+		if !isRetryableError(err) {
+			return nil, err
+		}
+		lastErr = err
+		log.Printf("Transient error getting the disk %q in zone %q, retrying: %q", diskName, zone, err.Error())
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = time.Duration(float64(backoff) * d.retryPolicy.Multiplier)
+		if backoff > d.retryPolicy.MaxBackoff {
+			backoff = d.retryPolicy.MaxBackoff
+		}
+	}
+	return nil, lastErr
+}
+
+// findExistingDisk looks for diskName, checking preferredZone first and
+// then falling back to scanning the Manager's other zones. This lets it
+// find a disk that a past zonal fallback placed outside of its
+// hash-preferred zone.
+//
+// A non-nil error other than "not found" means the caller could not
+// determine whether the disk exists (e.g. a persistent API failure), and
+// should be treated as a failure rather than as license to create a new
+// disk.
+func (d *Manager) findExistingDisk(ctx context.Context, diskName, preferredZone string) (*compute.Disk, string, error) {
+	disk, err := d.getDisk(ctx, preferredZone, diskName)
+	if err == nil {
+		return disk, preferredZone, nil
+	}
+	if !isNotFoundError(err) {
+		return nil, "", err
+	}
+	firstErr := err
+
+	for _, zone := range d.zones {
+		if zone == preferredZone {
+			continue
+		}
+		disk, err := d.getDisk(ctx, zone, diskName)
+		if err == nil {
+			return disk, zone, nil
+		}
+		if !isNotFoundError(err) {
+			return nil, "", err
+		}
+	}
+	return nil, "", firstErr
+}
+
 // GetForUser gets the persistent disk for the specified user,
 // creating it if it does not already exist.
 func (d *Manager) GetForUser(ctx context.Context, userEmail string) (*compute.Disk, error) {
 	diskName := d.GetDiskName(userEmail)
+	preferredZone := d.zoneForUser(userEmail)
 
 	log.Printf("Getting the disk %q for the user %q", diskName, userEmail)
 
-	disk, err := d.svc.Disks.Get(d.project, d.zone, diskName).Do()
+	diskType, sizeGB := d.diskParamsFor(userEmail)
+
+	disk, zone, err := d.findExistingDisk(ctx, diskName, preferredZone)
 	if err == nil {
-		disk, err = d.waitForDiskFinishedCreating(disk)
+		d.rememberZone(userEmail, zone)
+		disk, err = d.waitForDiskFinishedCreating(disk, zone)
 		if err != nil {
 			return nil, err
 		}
 		if disk.Status != diskStatusReady {
 			return nil, fmt.Errorf("Unexpected disk status: %q", disk.Status)
 		}
-		return disk, err
+		return d.resizeDiskIfNeeded(disk, zone, sizeGB)
+	}
+	if !isNotFoundError(err) {
+		return nil, err
 	}
 
-	// TODO(ojarjur): We are assuming any errors in the GET API mean
-	// the disk does not exist. We should actually check that.
-	disk, err = d.createNewDisk(ctx, diskName)
-
+	var userKey *compute.CustomerEncryptionKey
+	if d.keyForUser != nil {
+		userKey = d.keyForUser(userEmail)
+	}
+	disk, zone, err = d.createNewDisk(ctx, diskName, preferredZone, userKey, diskType, sizeGB)
 	if err != nil {
 		log.Printf("Failed to get the disk %q", diskName)
+		return nil, err
 	}
-	return disk, err
+	d.rememberZone(userEmail, zone)
+	return disk, nil
+}
+
+// userSnapshotLabelKey is the Compute Engine label used to tag snapshots
+// created by SnapshotUser with the disk they back up, so that
+// ListUserSnapshots can find them again.
+const userSnapshotLabelKey = "vm-manager-user"
+
+// snapshotKMSKeyNamePrefix marks a line appended to a backup snapshot's
+// Description recording the Cloud KMS key (if any) it was encrypted under.
+// RestoreUser reads this back instead of calling keyForUser again, since
+// keyForUser may have since been rotated to return a different key for the
+// user than the one this particular snapshot actually needs to be
+// decrypted/re-encrypted with. Compute Engine labels can't hold a full KMS
+// key resource name (they're capped at 63 characters of [a-z0-9_-]), so
+// this rides in the free-form Description instead.
+//
+// This only covers KMS-wrapped keys; a raw, customer-supplied key
+// (CustomerEncryptionKey.RawKey) is not persisted here, since writing key
+// material into a resource's Description would leak it to anyone who can
+// read the snapshot.
+const snapshotKMSKeyNamePrefix = "vm-manager-source-kms-key:"
+
+// appendKMSKeyName returns description with the given Cloud KMS key name
+// appended as a machine-readable line, or description unchanged if
+// kmsKeyName is empty.
+func appendKMSKeyName(description, kmsKeyName string) string {
+	if kmsKeyName == "" {
+		return description
+	}
+	return description + "\n" + snapshotKMSKeyNamePrefix + kmsKeyName
+}
+
+// kmsKeyFromDescription is the inverse of appendKMSKeyName, used by
+// RestoreUser to recover the key a snapshot was actually taken under. It
+// returns nil if description has no such line (e.g. the snapshot predates
+// this field, or was encrypted with a raw rather than KMS-wrapped key).
+func kmsKeyFromDescription(description string) *compute.CustomerEncryptionKey {
+	for _, line := range strings.Split(description, "\n") {
+		if name := strings.TrimPrefix(line, snapshotKMSKeyNamePrefix); name != line {
+			return &compute.CustomerEncryptionKey{KmsKeyName: name}
+		}
+	}
+	return nil
+}
+
+// SnapshotUser creates a labeled backup snapshot of the given user's disk.
+// Compute Engine snapshots can be taken of a disk while it is attached to a
+// running VM, so callers do not need to detach it first. The returned
+// snapshot's name can later be passed to RestoreUser.
+func (d *Manager) SnapshotUser(ctx context.Context, userEmail, label string) (*compute.Snapshot, error) {
+	diskName := d.GetDiskName(userEmail)
+	preferredZone := d.zoneForUser(userEmail)
+
+	disk, zone, err := d.findExistingDisk(ctx, diskName, preferredZone)
+	if err != nil {
+		return nil, err
+	}
+
+	var userKey *compute.CustomerEncryptionKey
+	if d.keyForUser != nil {
+		userKey = d.keyForUser(userEmail)
+	}
+
+	snapshotTimestamp := strings.ToLower(time.Now().Format("20060102-15-04-05-000-MST"))
+	snapshotName := fmt.Sprintf("%s-backup-%s", diskName, snapshotTimestamp)
+
+	description := label
+	if userKey != nil {
+		description = appendKMSKeyName(description, userKey.KmsKeyName)
+	}
+
+	log.Printf("Creating the backup snapshot %q of the disk %q", snapshotName, disk.Name)
+	op, err := d.svc.Disks.CreateSnapshot(d.project, zone, disk.Name, &compute.Snapshot{
+		Name:                    snapshotName,
+		Description:             description,
+		Labels:                  map[string]string{userSnapshotLabelKey: diskName},
+		SnapshotEncryptionKey:   userKey,
+		SourceDiskEncryptionKey: userKey,
+	}).Do()
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.WaitForZoneOperation(d.svc, d.project, zone, op.Name, pollingInterval); err != nil {
+		return nil, err
+	}
+	return d.svc.Snapshots.Get(d.project, snapshotName).Do()
+}
+
+// ListUserSnapshots returns the backup snapshots previously created for the
+// given user by SnapshotUser, in the order returned by the API.
+func (d *Manager) ListUserSnapshots(userEmail string) ([]*compute.Snapshot, error) {
+	diskName := d.GetDiskName(userEmail)
+	filter := fmt.Sprintf("labels.%s=%s", userSnapshotLabelKey, diskName)
+
+	var snapshots []*compute.Snapshot
+	call := d.svc.Snapshots.List(d.project).Filter(filter)
+	err := call.Pages(context.Background(), func(page *compute.SnapshotList) error {
+		snapshots = append(snapshots, page.Items...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// RestoreUser replaces the given user's disk with a new one created from
+// snapshotName (e.g. one previously returned by SnapshotUser or
+// ListUserSnapshots), reusing the same deterministic GetDiskName result so
+// that later GetForUser calls see the restored data.
+//
+// The caller is responsible for ensuring the user's disk is not currently
+// attached to a VM, the same way getOrCreateVM already does before
+// reassigning a disk away from a terminated VM; deleting an attached disk
+// fails.
+func (d *Manager) RestoreUser(ctx context.Context, userEmail, snapshotName string) error {
+	diskName := d.GetDiskName(userEmail)
+	preferredZone := d.zoneForUser(userEmail)
+
+	snapshot, err := d.svc.Snapshots.Get(d.project, snapshotName).Do()
+	if err != nil {
+		return err
+	}
+
+	zone := preferredZone
+	if disk, existingZone, err := d.findExistingDisk(ctx, diskName, preferredZone); err == nil {
+		zone = existingZone
+		log.Printf("Deleting the existing disk %q before restoring %q", disk.Name, snapshotName)
+		op, err := d.svc.Disks.Delete(d.project, zone, disk.Name).Do()
+		if err != nil {
+			return err
+		}
+		if err := utils.WaitForZoneOperation(d.svc, d.project, zone, op.Name, pollingInterval); err != nil {
+			return err
+		}
+	} else if !isNotFoundError(err) {
+		return err
+	}
+
+	// Use the key this snapshot was actually encrypted under, not whatever
+	// keyForUser currently returns for the user: if their key has been
+	// rotated since SnapshotUser ran, re-resolving it live would pass a
+	// mismatched key and the restore would fail (or silently protect the
+	// new disk with a key that can't decrypt the snapshot's data). Older
+	// snapshots with no recorded key (predating this field, or encrypted
+	// with a raw rather than KMS-wrapped key) fall back to the live
+	// callback, same as before.
+	userKey := kmsKeyFromDescription(snapshot.Description)
+	if userKey == nil && d.keyForUser != nil {
+		userKey = d.keyForUser(userEmail)
+	}
+	diskType, sizeGB := d.diskParamsFor(userEmail)
+	newDisk := &compute.Disk{
+		Name:                        diskName,
+		Description:                 "Allocated disk for a single user",
+		SourceSnapshot:              snapshot.SelfLink,
+		SourceSnapshotEncryptionKey: userKey,
+		DiskEncryptionKey:           userKey,
+		SizeGb:                      sizeGB,
+	}
+	if diskType != "" {
+		newDisk.Type = "zones/" + zone + "/diskTypes/" + diskType
+	}
+
+	log.Printf("Restoring the disk %q from the snapshot %q", diskName, snapshotName)
+	op, err := d.svc.Disks.Insert(d.project, zone, newDisk).Do()
+	if err != nil {
+		return err
+	}
+	if err := utils.WaitForZoneOperation(d.svc, d.project, zone, op.Name, pollingInterval); err != nil {
+		return err
+	}
+	d.rememberZone(userEmail, zone)
+	return nil
 }
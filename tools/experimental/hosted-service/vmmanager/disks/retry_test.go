@@ -0,0 +1,118 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disks
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// newTestManager returns a Manager backed by a fake Compute Engine server,
+// sufficient for exercising getDisk's retry logic in isolation.
+func newTestManager(t *testing.T, status func(attempt int) int, policy RetryPolicy) (*Manager, func()) {
+	t.Helper()
+	attempt := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempt++
+		if code := status(attempt); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&compute.Disk{Name: "test-disk", Status: diskStatusReady})
+	}))
+
+	svc, err := compute.New(server.Client())
+	if err != nil {
+		server.Close()
+		t.Fatalf("failed to create the Compute Engine client: %v", err)
+	}
+	svc.BasePath = server.URL + "/"
+
+	return &Manager{svc: svc, project: "test-project", retryPolicy: policy}, server.Close
+}
+
+var fastRetryPolicy = RetryPolicy{
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     5 * time.Millisecond,
+	Multiplier:     2,
+	MaxAttempts:    5,
+}
+
+func TestGetDiskRetriesTransientErrors(t *testing.T) {
+	var attempts int
+	d, closeServer := newTestManager(t, func(attempt int) int {
+		attempts = attempt
+		if attempt < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}, fastRetryPolicy)
+	defer closeServer()
+
+	disk, err := d.getDisk(context.Background(), "test-zone", "test-disk")
+	if err != nil {
+		t.Fatalf("getDisk returned an unexpected error: %v", err)
+	}
+	if disk.Name != "test-disk" {
+		t.Errorf("got disk name %q, want %q", disk.Name, "test-disk")
+	}
+	if attempts != 3 {
+		t.Errorf("got %d attempts, want 3", attempts)
+	}
+}
+
+func TestGetDiskDoesNotRetryNotFound(t *testing.T) {
+	var attempts int
+	d, closeServer := newTestManager(t, func(attempt int) int {
+		attempts = attempt
+		return http.StatusNotFound
+	}, fastRetryPolicy)
+	defer closeServer()
+
+	_, err := d.getDisk(context.Background(), "test-zone", "test-disk")
+	if !isNotFoundError(err) {
+		t.Fatalf("got error %v, want a not-found error", err)
+	}
+	if attempts != 1 {
+		t.Errorf("got %d attempts, want 1 (a not-found error must not be retried)", attempts)
+	}
+}
+
+func TestGetDiskGivesUpAfterMaxAttempts(t *testing.T) {
+	var attempts int
+	policy := fastRetryPolicy
+	policy.MaxAttempts = 3
+	d, closeServer := newTestManager(t, func(attempt int) int {
+		attempts = attempt
+		return http.StatusServiceUnavailable
+	}, policy)
+	defer closeServer()
+
+	if _, err := d.getDisk(context.Background(), "test-zone", "test-disk"); err == nil {
+		t.Fatal("expected getDisk to return an error after exhausting its retries")
+	}
+	if attempts != policy.MaxAttempts {
+		t.Errorf("got %d attempts, want %d (= MaxAttempts)", attempts, policy.MaxAttempts)
+	}
+}
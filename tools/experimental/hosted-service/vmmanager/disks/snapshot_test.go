@@ -0,0 +1,58 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disks
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKMSKeyNameRoundTrip(t *testing.T) {
+	description := appendKMSKeyName("my backup", "projects/p/locations/global/keyRings/r/cryptoKeys/k")
+
+	key := kmsKeyFromDescription(description)
+	if key == nil {
+		t.Fatal("got a nil key, want the key appended above")
+	}
+	if got, want := key.KmsKeyName, "projects/p/locations/global/keyRings/r/cryptoKeys/k"; got != want {
+		t.Errorf("got KmsKeyName %q, want %q", got, want)
+	}
+}
+
+func TestKMSKeyNameRoundTrip_NoKey(t *testing.T) {
+	// A snapshot taken with no encryption key (or one taken before this
+	// field existed) must not be mistaken for one that has a recorded key.
+	description := appendKMSKeyName("my backup", "")
+	if description != "my backup" {
+		t.Errorf("got description %q, want it unchanged by an empty key name", description)
+	}
+	if key := kmsKeyFromDescription(description); key != nil {
+		t.Errorf("got key %v, want nil for a description with no recorded key", key)
+	}
+}
+
+func TestKMSKeyNameSurvivesAlongsideUserLabel(t *testing.T) {
+	// appendKMSKeyName must not clobber the caller-supplied label/description
+	// that SnapshotUser also stores in the same field.
+	description := appendKMSKeyName("quarterly backup for alice", "projects/p/locations/global/keyRings/r/cryptoKeys/k")
+	if key := kmsKeyFromDescription(description); key == nil || key.KmsKeyName != "projects/p/locations/global/keyRings/r/cryptoKeys/k" {
+		t.Errorf("got key %v, want the appended KMS key name", key)
+	}
+	if want := "quarterly backup for alice"; !strings.HasPrefix(description, want) {
+		t.Errorf("got description %q, want it to start with the original label %q", description, want)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disks
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestZoneOrder(t *testing.T) {
+	d := &Manager{zones: []string{"z1", "z2", "z3"}}
+
+	if got, want := d.zoneOrder("z2"), []string{"z2", "z1", "z3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("zoneOrder(%q) = %v, want %v", "z2", got, want)
+	}
+
+	// A preferred zone outside the configured list (e.g. one recorded by a
+	// past fallback before the configured zones changed) is still tried
+	// first, falling back to every configured zone in order.
+	if got, want := d.zoneOrder("other"), []string{"other", "z1", "z2", "z3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("zoneOrder(%q) = %v, want %v", "other", got, want)
+	}
+}
+
+func TestZoneForUserIsStableAndConfigured(t *testing.T) {
+	d := &Manager{zones: []string{"z1", "z2", "z3"}, userZones: make(map[string]string)}
+
+	zone := d.zoneForUser("alice@example.com")
+	var found bool
+	for _, z := range d.zones {
+		found = found || z == zone
+	}
+	if !found {
+		t.Fatalf("zoneForUser returned %q, not one of the configured zones %v", zone, d.zones)
+	}
+	if again := d.zoneForUser("alice@example.com"); again != zone {
+		t.Errorf("zoneForUser is not stable across calls: got %q then %q", zone, again)
+	}
+}
+
+func TestZoneForUserPrefersRememberedZone(t *testing.T) {
+	d := &Manager{zones: []string{"z1", "z2", "z3"}, userZones: make(map[string]string)}
+
+	hashZone := d.zoneForUser("bob@example.com")
+	// A past zonal fallback may have placed the user's disk outside of
+	// its hash-selected zone; rememberZone must win over the hash.
+	fallbackZone := "z1"
+	if fallbackZone == hashZone {
+		fallbackZone = "z2"
+	}
+	d.rememberZone("bob@example.com", fallbackZone)
+
+	if got := d.zoneForUser("bob@example.com"); got != fallbackZone {
+		t.Errorf("zoneForUser = %q, want the remembered zone %q", got, fallbackZone)
+	}
+}
@@ -22,11 +22,12 @@ limitations under the License.
 //
 // And to use, run:
 //
-//    $ ~/bin/vm-manager -proxy-api <proxy-api-url> -project <project> -zone <zone>
+//    $ ~/bin/vm-manager -proxy-project <proxy-project> -project <project> -region <region>
 
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -36,6 +37,9 @@ import (
 	"strings"
 	"time"
 
+	"cloud.google.com/go/storage"
+	"github.com/gophercloud/gophercloud"
+	gcopenstack "github.com/gophercloud/gophercloud/openstack"
 	"golang.org/x/net/context"
 	compute "google.golang.org/api/compute/v1"
 	iam "google.golang.org/api/iam/v1"
@@ -44,6 +48,11 @@ import (
 	"vm-manager/proxy"
 	"vm-manager/utils"
 	"vm-manager/vms"
+	"vm-manager/vms/providers"
+	"vm-manager/vms/providers/azure"
+	"vm-manager/vms/providers/gce"
+	"vm-manager/vms/providers/openstack"
+	"vm-manager/vms/state"
 )
 
 const (
@@ -64,8 +73,22 @@ const (
 var (
 	proxyProject = flag.String("proxy-project", "", "Google Cloud Platform project hosting the inverting proxy")
 	project      = flag.String("project", "", "Google Cloud Platform project to use")
-	zone         = flag.String("zone", "", "Zone in which to run backends")
-	network      = flag.String("network", "default", "Network in which to run backends")
+	region       = flag.String("region", "", "Region in which to run backends; all of its healthy zones are used, with failover between them. Only consulted for -provider=gce")
+	network      = flag.String("network", "default", "Network in which to run backends; ignored if -subnetwork is set, since a shared-VPC subnetwork reference already fully identifies the network on its own, typically in a different (host) project than this one's own network of the same name")
+	subnetwork   = flag.String("subnetwork", "", "(Optional) subnetwork in which to run backends, e.g. for a shared-VPC reference of the form projects/<host-project>/regions/<region>/subnetworks/<name>; takes precedence over -network")
+
+	useInternalIPOnly = flag.Bool("internal-ip-only", false, "Create backends with no public IP, reachable only via their internal IP; requires Private Google Access (or an equivalent NAT gateway) on the subnetwork")
+	agentImage        = flag.String("agent-image", "", "(Optional) override for the proxy-agent image, e.g. a private registry mirror reachable from a -internal-ip-only network")
+
+	cloudProvider = flag.String("provider", "gce", "Cloud provider to run backend VMs on: \"gce\", \"azure\", or \"openstack\". Persistent per-user disks, and so end-to-end request serving via \"/\", are only implemented against GCE today; the other providers manage the backend VM pool itself but vm-manager refuses to start serving requests against them until disks.Manager grows a matching implementation")
+
+	azureSubscriptionID = flag.String("azure-subscription-id", "", "Azure subscription ID to create backend VMs in; required for -provider=azure")
+	azureResourceGroup  = flag.String("azure-resource-group", "", "Azure resource group to create backend VMs in; required for -provider=azure")
+	azureLocation       = flag.String("azure-location", "", "Azure location (e.g. \"westus2\") to create backend VMs in; required for -provider=azure")
+	azureSubnetID       = flag.String("azure-subnet-id", "", "Azure subnet resource ID to attach backend VM NICs to; required for -provider=azure")
+
+	openstackImageRef = flag.String("openstack-image-ref", "", "Glance image ID to boot backend VMs from; required for -provider=openstack")
+	openstackNetwork  = flag.String("openstack-network", "", "Neutron network UUID to attach backend VMs to; required for -provider=openstack")
 
 	sourceSnapshot = flag.String("source-snapshot", "user-disk-template", "Snapshot used to create user disks")
 	machineType    = flag.String("machine-type", "n1-standard-1", "Machine type for backends")
@@ -73,11 +96,28 @@ var (
 
 	allowedDomain = flag.String("allowed-domain", "", "(Optional) domain of which users must be members")
 
+	templateKMSKey = flag.String("template-kms-key", "", "(Optional) Cloud KMS key used to encrypt the template disk/snapshot, e.g. projects/p/locations/l/keyRings/r/cryptoKeys/k")
+
+	diskType   = flag.String("disk-type", "pd-standard", "Disk type to use for user disks (pd-standard, pd-ssd, pd-balanced)")
+	diskSizeGB = flag.Int64("disk-size-gb", 200, "Size, in GB, of user disks")
+
+	preemptibleFraction = flag.Float64("preemptible-fraction", 0, "Fraction (0 to 1) of the free VM pool to create as preemptible instances")
+	maxVMAge            = flag.Duration("max-vm-age", 0, "(Optional) hard cap on how long any backend VM may run before it is rotated out, regardless of whether it is idle")
+	idleVMTTL           = flag.Duration("idle-vm-ttl", 90*time.Minute, "How long a backend may sit idle before it is reaped, distinct from -max-vm-age")
+
+	minFreeVMCount  = flag.Int("min-free-vms", 2, "Minimum number of free backend VMs to keep on hand, regardless of recent demand")
+	maxFreeVMCount  = flag.Int("max-free-vms", 50, "Maximum number of free backend VMs to keep on hand, regardless of recent demand")
+	minFreeVMBuffer = flag.Int("free-vm-buffer", 2, "Extra free VMs to keep on top of the demand-based estimate")
+	warmupSeconds   = flag.Float64("vm-warmup-seconds", 120, "Expected time, in seconds, for a new backend VM to become ready; the free VM pool is sized to absorb this much demand at the recent assignment rate")
+
+	stateBucket = flag.String("pool-state-bucket", "", "(Optional) GCS bucket used to persist pool VM state across restarts; if unset, pool state is kept in memory only and is lost on restart")
+	statePrefix = flag.String("pool-state-prefix", "vm-manager/pool-state/", "Object name prefix used within -pool-state-bucket for persisted pool state")
+
 	port     = flag.Int("port", 8080, "Port on which to start the vm-manager server.")
 	diskInit = flag.String("disk-init", "", "Name of a file containing the disk initialization script")
 )
 
-func attachDiskToVM(computeService *compute.Service, vm *compute.Instance, disk *compute.Disk) error {
+func attachDiskToVM(computeService *compute.Service, vm *providers.Instance, disk *compute.Disk) error {
 	attachedDisk := &compute.AttachedDisk{
 		AutoDelete: false,
 		Boot:       false,
@@ -85,19 +125,32 @@ func attachDiskToVM(computeService *compute.Service, vm *compute.Instance, disk
 		DeviceName: "user-pd",
 		Source:     disk.SelfLink,
 	}
-	attachOp, err := computeService.Instances.AttachDisk(*project, *zone, vm.Name, attachedDisk).Do()
+	attachOp, err := computeService.Instances.AttachDisk(*project, vm.Zone, vm.Name, attachedDisk).Do()
 	if err != nil {
 		log.Printf("Failed to attach the disk: %q", err.Error())
 		return err
 	}
-	if err := utils.WaitForZoneOperation(computeService, *project, *zone, attachOp.Name, 10*time.Millisecond); err != nil {
+	if err := utils.WaitForZoneOperation(computeService, *project, vm.Zone, attachOp.Name, 10*time.Millisecond); err != nil {
 		log.Printf("Failed to attach the disk: %q", err.Error())
 		return err
 	}
 	return nil
 }
 
-func getOrCreateVM(ctx context.Context, computeService *compute.Service, diskManager *disks.Manager, vmPool *vms.Pool, user string) (*compute.Instance, error) {
+func detachDiskFromVM(computeService *compute.Service, vm *providers.Instance) error {
+	detachOp, err := computeService.Instances.DetachDisk(*project, vm.Zone, vm.Name, "user-pd").Do()
+	if err != nil {
+		log.Printf("Failed to detach the disk: %q", err.Error())
+		return err
+	}
+	if err := utils.WaitForZoneOperation(computeService, *project, vm.Zone, detachOp.Name, 10*time.Millisecond); err != nil {
+		log.Printf("Failed to detach the disk: %q", err.Error())
+		return err
+	}
+	return nil
+}
+
+func getOrCreateVM(ctx context.Context, computeService *compute.Service, diskManager *disks.Manager, vmPool *vms.Pool, user string) (*providers.Instance, error) {
 	for i := 0; i < 10; i++ {
 		disk, err := diskManager.GetForUser(ctx, user)
 		if err != nil {
@@ -106,13 +159,36 @@ func getOrCreateVM(ctx context.Context, computeService *compute.Service, diskMan
 		log.Printf("Fetched the disk %q for the user %q\n", disk.Name, user)
 
 		if len(disk.Users) > 0 {
+			// instancePath has the form "projects/P/zones/Z/instances/I".
 			instancePath := disk.Users[0]
-			instanceName := instancePath[strings.LastIndex(instancePath, "/")+1:]
-			log.Printf("The disk is already attached to %q\n", instanceName)
-			return computeService.Instances.Get(*project, *zone, instanceName).Do()
+			pathParts := strings.Split(instancePath, "/")
+			instanceZoneName := pathParts[3]
+			instanceName := pathParts[5]
+			rawInstance, err := computeService.Instances.Get(*project, instanceZoneName, instanceName).Do()
+			if err != nil {
+				return nil, err
+			}
+			instance := gce.ToInstance(rawInstance)
+			if instance.Status != "TERMINATED" {
+				log.Printf("The disk is already attached to %q\n", instanceName)
+				return instance, nil
+			}
+
+			// The VM that owned this disk was preempted out from under the
+			// user. Detach the disk and delete the dead VM so the next pass
+			// through this loop re-attaches it to a fresh pool VM.
+			log.Printf("The disk's owning VM %q was preempted; reassigning to a new VM\n", instanceName)
+			if err := detachDiskFromVM(computeService, instance); err != nil {
+				return nil, err
+			}
+			if err := vmPool.DeleteVM(ctx, instance); err != nil {
+				return nil, err
+			}
+			continue
 		}
 
-		vm, err := vmPool.WaitForVM(ctx, user)
+		diskZone := disk.Zone[strings.LastIndex(disk.Zone, "/")+1:]
+		vm, err := vmPool.WaitForVM(ctx, user, diskZone)
 		if err != nil {
 			return nil, err
 		}
@@ -137,6 +213,58 @@ func handleUserRequest(ctx context.Context, computeService *compute.Service, dis
 	return proxyAdmin.RegisterBackend(vm, user)
 }
 
+// newVMProvider builds the providers.Provider selected by -provider, along
+// with the zones (or provider-equivalent, e.g. Azure's single location, or
+// OpenStack's Nova availability zones) that vms.Pool should round-robin VM
+// placement across.
+func newVMProvider(computeService *compute.Service, iamService *iam.Service, project string) (providers.Provider, []string, error) {
+	switch *cloudProvider {
+	case "gce":
+		zones, err := utils.ListZones(computeService, project, *region)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gce.New(computeService, iamService, project, zones), zones, nil
+
+	case "azure":
+		if *azureSubscriptionID == "" || *azureResourceGroup == "" || *azureLocation == "" || *azureSubnetID == "" {
+			return nil, nil, fmt.Errorf("-azure-subscription-id, -azure-resource-group, -azure-location, and -azure-subnet-id are all required for -provider=azure")
+		}
+		p, err := azure.New(*azureSubscriptionID, *azureResourceGroup, *azureLocation, *azureSubnetID)
+		if err != nil {
+			return nil, nil, err
+		}
+		// This provider does not place VMs across zones within a location,
+		// so the pool is given a single "zone" to round-robin over.
+		return p, []string{*azureLocation}, nil
+
+	case "openstack":
+		if *openstackImageRef == "" || *openstackNetwork == "" {
+			return nil, nil, fmt.Errorf("-openstack-image-ref and -openstack-network are both required for -provider=openstack")
+		}
+		authOpts, err := gophercloud.AuthOptionsFromEnv()
+		if err != nil {
+			return nil, nil, err
+		}
+		authClient, err := gcopenstack.AuthenticatedClient(authOpts)
+		if err != nil {
+			return nil, nil, err
+		}
+		computeClient, err := gcopenstack.NewComputeV2(authClient, gophercloud.EndpointOpts{})
+		if err != nil {
+			return nil, nil, err
+		}
+		p, err := openstack.New(computeClient, *openstackImageRef, *openstackNetwork)
+		if err != nil {
+			return nil, nil, err
+		}
+		return p, p.AvailabilityZones(), nil
+
+	default:
+		return nil, nil, fmt.Errorf("unrecognized -provider %q: must be \"gce\", \"azure\", or \"openstack\"", *cloudProvider)
+	}
+}
+
 func main() {
 	flag.Parse()
 
@@ -150,8 +278,8 @@ func main() {
 		os.Exit(1)
 	}
 
-	if *zone == "" {
-		fmt.Println("You must specify the GCP zone to use")
+	if *region == "" {
+		fmt.Println("You must specify the GCP region to use")
 		os.Exit(1)
 	}
 
@@ -189,12 +317,44 @@ func main() {
 		}
 		diskInitScript = string(diskInitBytes)
 	}
-	diskManager, err := disks.NewManager(ctx, computeService, *project, *zone, *sourceSnapshot, diskInitScript, 200, *network)
+	vmProvider, vmZones, err := newVMProvider(computeService, iamService, *project)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *cloudProvider != "gce" {
+		// disks.Manager, and so getOrCreateVM/handleUserRequest below, only
+		// know how to manage GCE persistent disks; refuse to start serving
+		// requests against a provider they can't back yet, rather than
+		// failing confusingly on the first request.
+		log.Fatalf("-provider=%q is not yet supported end-to-end: persistent per-user disks are only implemented against GCE", *cloudProvider)
+	}
 
-	vmPool, err := vms.NewPool(ctx, computeService, iamService, proxyAdmin, proxyURL, proxiedHostname, *project, *zone, *network, *machineType, *image)
+	diskZones, err := utils.ListZones(computeService, *project, *region)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var templateKey *compute.CustomerEncryptionKey
+	if *templateKMSKey != "" {
+		templateKey = &compute.CustomerEncryptionKey{KmsKeyName: *templateKMSKey}
+	}
+	diskManager, err := disks.NewManager(ctx, computeService, *project, diskZones, *sourceSnapshot, diskInitScript, 200, *network, templateKey, nil, *diskType, *diskSizeGB, nil, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var stateStore state.StateStore
+	if *stateBucket != "" {
+		storageClient, err := storage.NewClient(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		stateStore = state.NewGCSStore(storageClient, *stateBucket, *statePrefix)
+	} else {
+		log.Printf("No -pool-state-bucket given; pool state will not survive a restart")
+	}
+
+	vmPool, err := vms.NewPool(ctx, vmProvider, proxyAdmin, proxyURL, proxiedHostname, *project, vmZones, *network, *subnetwork, *useInternalIPOnly, *machineType, *image, *agentImage, *preemptibleFraction, *maxVMAge, *idleVMTTL, *minFreeVMCount, *maxFreeVMCount, *minFreeVMBuffer, *warmupSeconds, stateStore)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -208,6 +368,17 @@ func main() {
 	http.HandleFunc("/_ah/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("ok"))
 	})
+	http.HandleFunc("/_ah/vm_pool_metrics", func(w http.ResponseWriter, r *http.Request) {
+		metrics, err := vmPool.Metrics(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(metrics); err != nil {
+			log.Printf("Failed to encode the VM pool metrics: %q", err.Error())
+		}
+	})
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		requestCtx, cancelFn := context.WithCancel(ctx)
@@ -28,9 +28,7 @@ import (
 	"strings"
 	"time"
 
-	compute "google.golang.org/api/compute/v1"
-
-	"vm-manager/utils"
+	"vm-manager/vms/providers"
 )
 
 const (
@@ -86,16 +84,15 @@ func (a *Admin) backendsURL() string {
 
 // RegisterBackend registers that the given VM should act as a sever
 // backend for the specified user.
-func (a *Admin) RegisterBackend(vm *compute.Instance, user string) error {
-	backendID, err := utils.GetMetadataEntry(vm, "backend-id")
-	if err != nil {
-		return err
+func (a *Admin) RegisterBackend(vm *providers.Instance, user string) error {
+	backendID, ok := vm.Metadata[providers.BackendIDKey]
+	if !ok {
+		return fmt.Errorf("No metadata entry for %q", providers.BackendIDKey)
 	}
-	serviceAccount := vm.ServiceAccounts[0].Email
 	backend := &Backend{
 		ID:           backendID,
 		EndUser:      user,
-		BackendUser:  serviceAccount,
+		BackendUser:  vm.ServiceAccountEmail,
 		PathPrefixes: []string{"/"},
 	}
 	log.Printf("Sending proxy admin request:\n%q\n", backend)
@@ -116,6 +113,29 @@ func (a *Admin) RegisterBackend(vm *compute.Instance, user string) error {
 	return nil
 }
 
+// UnregisterBackend removes the given backend from the proxy, so that it is
+// no longer considered a valid destination for any user's requests.
+//
+// Callers should only do this once they are sure the backend's VM is about
+// to be deleted, since after this call the proxy will reject requests for
+// the backend rather than queueing them.
+func (a *Admin) UnregisterBackend(backendID string) error {
+	req, err := http.NewRequest(http.MethodDelete, a.backendsURL()+"/"+backendID, nil)
+	if err != nil {
+		return err
+	}
+	adminResp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Received proxy admin response:\n%q\n", adminResp.Status)
+	if adminResp.StatusCode != http.StatusOK && adminResp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("Unexpected status code in proxy admin response: %d [%q]", adminResp.StatusCode, adminResp.Status)
+	}
+	return nil
+}
+
 // IdleBackends returns the list of all backends that have been idle
 // for longer than the specified duration.
 func (a *Admin) IdleBackends(idleDuration time.Duration) ([]string, error) {
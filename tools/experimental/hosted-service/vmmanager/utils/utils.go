@@ -26,6 +26,7 @@ import (
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
 	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
 )
 
 const EmailScope = "https://www.googleapis.com/auth/userinfo.email"
@@ -69,7 +70,29 @@ func WaitForZoneOperation(svc *compute.Service, project, zone, operationName str
 	}
 }
 
-func CreateVM(svc *compute.Service, project, zone, instanceName, description, machineType, network, serviceAccount string, bootDiskSizeGB int64, metadata map[string]*string, pollingInterval time.Duration) error {
+// NetworkConfig describes how a VM's network interface should be configured.
+type NetworkConfig struct {
+	// Network is the network to attach the VM to, e.g. "default". Ignored
+	// if Subnetwork is non-empty.
+	Network string
+
+	// Subnetwork, if non-empty, is attached to instead of Network, and
+	// fully identifies the network on its own - CreateVM does not also set
+	// Network in this case. It may be a full shared-VPC reference (e.g.
+	// "projects/<host-project>/regions/<region>/subnetworks/<name>") so
+	// that VMs can be created in a subnetwork owned by a different, host
+	// project, whose own Network would otherwise mismatch.
+	Subnetwork string
+
+	// UseInternalIPOnly, if true, omits the ephemeral external IP that VMs
+	// otherwise get by default, so the VM is only reachable (and only has
+	// egress) via its internal IP. This requires Private Google Access
+	// (or an equivalent NAT gateway) to be configured on the subnetwork
+	// for the VM to reach the internet at all.
+	UseInternalIPOnly bool
+}
+
+func CreateVM(svc *compute.Service, project, zone, instanceName, description, machineType string, netCfg NetworkConfig, serviceAccount string, bootDiskSizeGB int64, scheduling *compute.Scheduling, metadata map[string]*string, pollingInterval time.Duration) error {
 	metadataItems := []*compute.MetadataItems{}
 	for k, v := range metadata {
 		metadataItems = append(metadataItems, &compute.MetadataItems{
@@ -77,6 +100,25 @@ func CreateVM(svc *compute.Service, project, zone, instanceName, description, ma
 			Value: v,
 		})
 	}
+	networkInterface := &compute.NetworkInterface{}
+	if netCfg.Subnetwork != "" {
+		// A shared-VPC subnetwork reference
+		// ("projects/<host-project>/regions/<region>/subnetworks/<name>")
+		// already fully identifies the network; it lives in a different
+		// (host) project than this one's own Network, so setting both
+		// would send a mismatched pair that Instances.Insert rejects.
+		networkInterface.Subnetwork = netCfg.Subnetwork
+	} else {
+		networkInterface.Network = "global/networks/" + netCfg.Network
+	}
+	if !netCfg.UseInternalIPOnly {
+		networkInterface.AccessConfigs = []*compute.AccessConfig{
+			&compute.AccessConfig{
+				Name: "external-nat",
+				Type: "ONE_TO_ONE_NAT",
+			},
+		}
+	}
 	instance := &compute.Instance{
 		Description: description,
 		Name:        instanceName,
@@ -95,17 +137,8 @@ func CreateVM(svc *compute.Service, project, zone, instanceName, description, ma
 		Metadata: &compute.Metadata{
 			Items: metadataItems,
 		},
-		NetworkInterfaces: []*compute.NetworkInterface{
-			&compute.NetworkInterface{
-				AccessConfigs: []*compute.AccessConfig{
-					&compute.AccessConfig{
-						Name: "external-nat",
-						Type: "ONE_TO_ONE_NAT",
-					},
-				},
-				Network: "global/networks/" + network,
-			},
-		},
+		Scheduling:        scheduling,
+		NetworkInterfaces: []*compute.NetworkInterface{networkInterface},
 	}
 	if serviceAccount != "" {
 		instance.ServiceAccounts = []*compute.ServiceAccount{
@@ -122,11 +155,44 @@ func CreateVM(svc *compute.Service, project, zone, instanceName, description, ma
 	return WaitForZoneOperation(svc, project, zone, instanceOp.Name, pollingInterval)
 }
 
-func GetMetadataEntry(vm *compute.Instance, key string) (string, error) {
-	for _, item := range vm.Metadata.Items {
-		if item.Key == key {
-			return *item.Value, nil
+// ListZones returns the names of all zones in the given region that are
+// currently reporting as healthy ("UP"), in the order returned by the API.
+func ListZones(svc *compute.Service, project, region string) ([]string, error) {
+	regionPath := "regions/" + region
+	var zones []string
+	call := svc.Zones.List(project)
+	err := call.Pages(context.Background(), func(page *compute.ZoneList) error {
+		for _, zone := range page.Items {
+			if zone.Region != "" && !strings.HasSuffix(zone.Region, regionPath) {
+				continue
+			}
+			if zone.Status != "UP" {
+				continue
+			}
+			zones = append(zones, zone.Name)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(zones) == 0 {
+		return nil, fmt.Errorf("no healthy zones found in region %q", region)
+	}
+	return zones, nil
+}
+
+// IsStockoutError returns whether the given error from a Compute Engine
+// Insert call indicates that the zone is out of the requested resource
+// (e.g. "ZONE_RESOURCE_POOL_EXHAUSTED"), as opposed to some other failure.
+// Callers can use this to decide whether it is worth retrying in another
+// zone.
+func IsStockoutError(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
 	}
-	return "", fmt.Errorf("No metadata entry for %q", key)
+	return strings.Contains(apiErr.Body, "ZONE_RESOURCE_POOL_EXHAUSTED") ||
+		strings.Contains(apiErr.Body, "QUOTA_EXCEEDED") ||
+		strings.Contains(apiErr.Message, "ZONE_RESOURCE_POOL_EXHAUSTED")
 }
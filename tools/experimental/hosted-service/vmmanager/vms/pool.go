@@ -18,7 +18,6 @@ limitations under the License.
 package vms
 
 import (
-	"bytes"
 	"crypto/rand"
 	"errors"
 	"fmt"
@@ -26,16 +25,16 @@ import (
 	"math"
 	"math/big"
 	"sort"
-	"text/template"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/groupcache/lru"
 	"golang.org/x/net/context"
-	compute "google.golang.org/api/compute/v1"
-	iam "google.golang.org/api/iam/v1"
 
 	"vm-manager/proxy"
-	"vm-manager/utils"
+	"vm-manager/vms/providers"
+	"vm-manager/vms/state"
 )
 
 const (
@@ -43,221 +42,57 @@ const (
 	vmWaitTimeout              = 30 * time.Second
 	assignmentTimeLimit        = 12 * time.Hour
 	partialAssignmentTimeLimit = 1 * time.Minute
-	idleDuration               = 90 * time.Minute
-	creationTimeLimit          = 3 * 24 * time.Hour
 
-	targetFreeVMCount = 10
+	// defaultIdleVMTTL is used by Pools created with a zero idleVMTTL.
+	defaultIdleVMTTL = 90 * time.Minute
+
+	// standardCreationTimeLimit and preemptibleCreationTimeLimit bound how
+	// long an unassigned pool VM may sit around before it is considered
+	// out of date, per isOutOfDate. Preemptible (spot) instances get a
+	// tighter limit since GCE hard-terminates them after 24h regardless.
+	standardCreationTimeLimit    = 3 * 24 * time.Hour
+	preemptibleCreationTimeLimit = 20 * time.Hour
+
+	// assignmentWindow is the sliding window over which Pool.targetFreeVMCount
+	// computes the recent VM assignment rate.
+	assignmentWindow = 5 * time.Minute
 
 	vmCacheLimit = 1000
 	vmChanSize   = 1000
 
-	assignAttemptLimit  = 10
-	backendIDKey        = "backend-id"
-	forUserKey          = "for-user"
-	forUserTimestampKey = "for-user-timestamp"
+	assignAttemptLimit = 10
+
+	userVMBootDiskSizeGB = 20
 )
 
-var cloudConfigTmplText = `#cloud-config
-users:
-- name: backend
-  uid: 2000
-  groups: docker
-- name: agent
-  uid: 2001
-  groups: docker
-
-write_files:
-- path: /etc/systemd/system/waitfordiskready.sh
-  permissions: 0744
-  owner: root
-  content: |
-    PERSISTENT_DISK_DEV="/dev/disk/by-id/google-user-pd"
-    MOUNT_DIR="/mnt/disks/user-pd"
-    MOUNT_CMD="mount -o discard,defaults ${PERSISTENT_DISK_DEV} ${MOUNT_DIR}"
-
-    wait_for_disk() {
-      echo "Waiting for the persistent disk to be attached"
-      while [ ! -e "${PERSISTENT_DISK_DEV}" ]; do
-        sleep 1
-      done
-      echo "The persistent disk has been attached"
-    }
-
-    mount_disk() {
-      if mount | grep "${MOUNT_DIR}" > /dev/null; then
-        echo "The persistent disk has already been mounted"
-      else
-        echo "Mounting the persistent disk"
-        mkdir -p "${MOUNT_DIR}"
-        ${MOUNT_CMD}
-      fi
-    }
-    wait_for_disk
-    mount_disk
-
-- path: /etc/systemd/system/pullimages.sh
-  permissions: 0744
-  owner: root
-  content: |
-    docker pull gcr.io/inverting-proxy/agent
-    docker pull {{.ApplicationImage}}
-
-- path: /etc/systemd/system/waitfordisk.service
-  permissions: 0644
-  owner: root
-  content: |
-    [Unit]
-    Description=wait for disk
-    Requires=network-online.target
-    After=network-online.target setup.service
-
-    [Service]
-    Type=oneshot
-    ExecStart=/bin/bash /etc/systemd/system/waitfordiskready.sh
-
-- path: /etc/systemd/system/pullimages.service
-  permissions: 0644
-  owner: root
-  content: |
-    [Unit]
-    Description=pull docker images
-    Requires=network-online.target
-    After=network-online.target setup.service
-
-    [Service]
-    Type=oneshot
-    ExecStart=/bin/bash /etc/systemd/system/pullimages.sh
-
-- path: /etc/systemd/system/backend.service
-  permissions: 0644
-  owner: root
-  content: |
-    [Unit]
-    Description=backend docker container
-    Requires=network-online.target waitfordisk.service
-    After=network-online.target waitfordisk.service
-    [Service]
-    ExecStartPre=-/usr/bin/docker rm -fv backend
-    ExecStart=/usr/bin/docker run --rm \
-        --name=backend \
-        -p 127.0.0.1:8080:8080 \
-        -v /mnt/disks/user-pd:/content \
-        --hostname "{{.ProxiedHostname}}" \
-        --env=CLOUD_SDK_CORE_PROJECT="" \
-        --env=NO_GCE_CHECK="True" \
-        {{.ApplicationImage}}
-    Restart=always
-    RestartSec=1
-
-- path: /etc/systemd/system/agent.service
-  permissions: 0644
-  owner: root
-  content: |
-    [Unit]
-    Description=proxy agent docker container
-    Requires=network-online.target waitfordisk.service
-    After=network-online.target waitfordisk.service
-
-    [Service]
-    Environment="HOME=/home/agent"
-    ExecStartPre=-/usr/bin/docker rm -fv agent
-    ExecStart=/usr/bin/docker -D run --net=host -t --rm -u 0 \
-       --name=agent \
-       --env="BACKEND={{.BackendID}}" \
-       --env="PROXY={{.ProxyURL}}" \
-       gcr.io/inverting-proxy/agent
-    Restart=always
-    RestartSec=1
-
-runcmd:
-- systemctl daemon-reload
-- systemctl start pullimages.service
-- systemctl start waitfordisk.service
-- systemctl start backend.service
-- systemctl start agent.service
-`
-
-type byTimestamp []*compute.Instance
+type byTimestamp []*providers.Instance
 
 func (t byTimestamp) Len() int           { return len(t) }
 func (t byTimestamp) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
-func (t byTimestamp) Less(i, j int) bool { return t[i].CreationTimestamp < t[j].CreationTimestamp }
-
-// A Config holds the creation-time parameters for a per-user VM.
-type Config struct {
-	InstanceName       string
-	ServiceAccountName string
-	ProxyURL           string
-	ApplicationImage   string
-	BackendID          string
-	ProxiedHostname    string
-}
-
-func (c *Config) getCloudConfig() (string, error) {
-	t := template.Must(template.New(cloudConfigTmplText).Parse(cloudConfigTmplText))
-
-	var b bytes.Buffer
-	if err := t.Execute(&b, c); err != nil {
-		return "", err
-	}
-	return b.String(), nil
-}
-
-func (c *Config) getMetadata() (map[string]*string, error) {
-	cloudConfig, err := c.getCloudConfig()
-	if err != nil {
-		return nil, err
-	}
-	emptyForUser := ""
-	metadata := map[string]*string{
-		"user-data":  &cloudConfig,
-		backendIDKey: &c.BackendID,
-		forUserKey:   &emptyForUser,
-	}
-	return metadata, nil
-}
-
-// A Pool is a collection of unallocated virtual machines.
-type Pool struct {
-	computeSvc *compute.Service
-	iamSvc     *iam.Service
-	proxyAdmin *proxy.Admin
-
-	proxyURL         string
-	proxiedHostname  string
-	project          string
-	zone             string
-	network          string
-	machineType      string
-	applicationImage string
+func (t byTimestamp) Less(i, j int) bool { return t[i].Created.Before(t[j].Created) }
 
-	freeVMChan chan *compute.Instance
-}
-
-func isIdle(vm *compute.Instance, idleBackends map[string]struct{}) bool {
-	backendID, err := utils.GetMetadataEntry(vm, backendIDKey)
-	if err != nil {
+func isIdle(vm *providers.Instance, idleBackends map[string]struct{}) bool {
+	backendID, ok := vm.Metadata[providers.BackendIDKey]
+	if !ok {
 		// This is not a backend VM, so it cannot be an idle backend
 		return false
 	}
-	if _, ok := idleBackends[backendID]; ok {
-		return true
-	}
-	return false
+	_, idle := idleBackends[backendID]
+	return idle
 }
 
-func isUnassigned(vm *compute.Instance) bool {
-	forUser, err := utils.GetMetadataEntry(vm, forUserKey)
-	if err != nil {
+func isUnassigned(vm *providers.Instance) bool {
+	forUser, ok := vm.Metadata[providers.ForUserKey]
+	if !ok {
 		// This means VM was not created to be part of the pool
 		return false
 	}
-	return len(vm.Disks) == 1 && forUser == ""
+	return !vm.HasExtraDisk && forUser == ""
 }
 
-func assignedForTooLong(vm *compute.Instance) bool {
-	forUserTimestamp, err := utils.GetMetadataEntry(vm, forUserTimestampKey)
-	if err != nil {
+func assignedForTooLong(vm *providers.Instance) bool {
+	forUserTimestamp, ok := vm.Metadata[providers.ForUserTimestampKey]
+	if !ok {
 		// This VM has never been assigned
 		return false
 	}
@@ -276,57 +111,268 @@ func assignedForTooLong(vm *compute.Instance) bool {
 	// VM), while the second is used to ensure that successfully assigned
 	// VMs get reclaimed periodically.
 
-	if len(vm.Disks) > 1 {
+	if vm.HasExtraDisk {
 		// The VM was fully assigned
 		return time.Since(assignmentTime) > assignmentTimeLimit
-	} else {
-		// The VM was only partially assigned
-		return time.Since(assignmentTime) > partialAssignmentTimeLimit
 	}
+	// The VM was only partially assigned
+	return time.Since(assignmentTime) > partialAssignmentTimeLimit
 }
 
-func isOutOfDate(vm *compute.Instance) bool {
+func isOutOfDate(vm *providers.Instance) bool {
 	if !isUnassigned(vm) {
 		// We only use this check for unassigned VMs. Assigned VMs have a
 		// different expiration policy.
 		return false
 	}
+	if vm.Preemptible {
+		return time.Since(vm.Created) > preemptibleCreationTimeLimit
+	}
+	return time.Since(vm.Created) > standardCreationTimeLimit
+}
 
-	creationTime, err := time.Parse(time.RFC3339, vm.CreationTimestamp)
-	if err != nil {
-		log.Printf("Malformed creation timestamp: %q[%q]", vm.CreationTimestamp, err.Error())
+// isPreempted reports whether vm is a preemptible instance that has already
+// been reclaimed by the provider. Unlike isOutOfDate, this applies
+// regardless of assignment state: a preempted VM is gone the moment it is
+// preempted, so it needs to be noticed and replaced (or, if it still owns a
+// user's disk, detected by the disk-attachment path in manager.go) as soon
+// as possible rather than waiting for its creation-time limit to elapse.
+func isPreempted(vm *providers.Instance) bool {
+	return vm.Preemptible && vm.Status == "TERMINATED"
+}
+
+// exceedsMaxAge reports whether vm has been running longer than maxAge,
+// regardless of its assignment state. A zero maxAge means there is no cap.
+func exceedsMaxAge(vm *providers.Instance, maxAge time.Duration) bool {
+	if maxAge <= 0 {
 		return false
 	}
-	return time.Since(creationTime) > creationTimeLimit
+	return time.Since(vm.Created) > maxAge
+}
+
+// A Pool is a collection of unallocated virtual machines.
+type Pool struct {
+	provider   providers.Provider
+	proxyAdmin *proxy.Admin
+
+	// stateStore persists what the pool knows about each VM (its phase and,
+	// once assigned, its user) so that a restart can reconcile in-memory
+	// state (the free VM channel) against it instead of starting blind.
+	stateStore state.StateStore
+
+	proxyURL         string
+	proxiedHostname  string
+	project          string
+	network          string
+	subnetwork       string
+	machineType      string
+	applicationImage string
+
+	// useInternalIPOnly, if true, creates pool VMs with no public IP, so
+	// they are only reachable (and only have egress) via their internal IP
+	// on network/subnetwork. agentImage must then point at a registry
+	// mirror reachable from inside that network.
+	useInternalIPOnly bool
+
+	// agentImage, if non-empty, overrides the default proxy-agent image,
+	// e.g. to point at a private registry mirror for useInternalIPOnly
+	// deployments that have no public egress.
+	agentImage string
+
+	// preemptibleFraction is the share (0 to 1) of targetFreeVMCount that
+	// Fill provisions as preemptible (spot) instances rather than standard
+	// ones. A zero value means the pool is entirely standard instances.
+	preemptibleFraction float64
+
+	// zones is the ranked list of zones that pool VMs may be created in.
+	// createVM tries them round-robin, falling back to the next zone in
+	// the list on a zonal stockout.
+	zones []string
+
+	// zoneIdxMu guards nextZoneIdx.
+	zoneIdxMu   sync.Mutex
+	nextZoneIdx int
+
+	// maxVMAge is a hard cap on how long any pool VM (whether assigned or
+	// not) may run before being rotated out, e.g. so that it picks up a
+	// patched image. A zero value disables the cap.
+	maxVMAge time.Duration
+
+	// idleVMTTL is how long a backend may sit idle (per proxyAdmin's
+	// notion of idleness) before KillOldVMs reaps it. Distinct from
+	// maxVMAge, which is a hard cap regardless of idleness.
+	idleVMTTL time.Duration
+
+	freeVMChan chan *providers.Instance
+
+	// minFreeVMCount and maxFreeVMCount clamp the adaptive target computed
+	// by targetFreeVMCount.
+	minFreeVMCount int
+	maxFreeVMCount int
+
+	// minFreeVMBuffer is added on top of the demand-based estimate, so
+	// there is always some slack even when recent demand is zero.
+	minFreeVMBuffer int
+
+	// warmupSeconds is how long, in seconds, a newly created VM takes to
+	// become ready for use; the adaptive target aims to keep enough free
+	// VMs on hand to cover this much demand at the recent assignment rate.
+	warmupSeconds float64
+
+	// assignMu guards assignTimes.
+	assignMu    sync.Mutex
+	assignTimes []time.Time
+
+	// pendingWaits is the number of goroutines currently blocked in
+	// WaitForVM, surfaced via Metrics.
+	pendingWaits int32
+}
+
+// reconcileState cross-references the provider's live VM list against
+// pool.stateStore and primes freeVMChan/previouslySeenVMs accordingly, so
+// that a freshly-started Pool resumes where the last one left off instead
+// of starting blind:
+//
+//   - A VM the store remembers as free is pushed onto freeVMChan, provided
+//     its live metadata still agrees that it is unassigned.
+//   - A VM the store remembers as assigned is left alone, unless its live
+//     metadata shows the assignment never actually landed (the process
+//     must have crashed between the state-store write in assignVM and the
+//     subsequent SetMetadata call), in which case the stale record is
+//     cleared and the VM rejoins the free pool.
+//   - A live VM with no record at all (e.g. created but the process
+//     crashed before createVM could persist it) is left for the next Fill
+//     cycle and KillOldVMs to sort out based on its live metadata.
+func (pool *Pool) reconcileState(ctx context.Context, previouslySeenVMs *lru.Cache) error {
+	liveVMs, err := pool.provider.List(ctx)
+	if err != nil {
+		return err
+	}
+	records, err := pool.stateStore.List(ctx)
+	if err != nil {
+		return err
+	}
+	recordsByBackendID := make(map[string]state.Record, len(records))
+	for _, rec := range records {
+		recordsByBackendID[rec.BackendID] = rec
+	}
+
+	for _, vm := range liveVMs {
+		backendID, ok := vm.Metadata[providers.BackendIDKey]
+		if !ok {
+			continue
+		}
+		rec, tracked := recordsByBackendID[backendID]
+		if !tracked {
+			continue
+		}
+		previouslySeenVMs.Add(vm.ID, vm.ID)
+		if rec.Phase == state.PhaseFree && isUnassigned(vm) {
+			log.Printf("Resuming the free pool VM %q from persisted state", vm.Name)
+			pool.freeVMChan <- vm
+			continue
+		}
+		if rec.Phase == state.PhaseAssigned && isUnassigned(vm) {
+			log.Printf("Clearing the stale assignment of %q to %q: it never reached the VM", vm.Name, rec.ForUser)
+			if err := pool.stateStore.Delete(ctx, backendID); err != nil {
+				log.Printf("Failed to clear the stale assignment state for %q: %q", vm.Name, err.Error())
+			}
+			pool.freeVMChan <- vm
+		}
+	}
+	return nil
 }
 
-// NewPool creates a new VM pool in the given project/zone combination.
+// NewPool creates a new VM pool on top of the given Provider, spread across
+// zones.
 //
 // The `applicationImage` value specifies the full path of a Docker image that
 // will run on the VM once the user's disk has been attached to it.
 //
 // The user's disk will be volume mounted into the Docker container at `/content`.
-func NewPool(ctx context.Context, computeService *compute.Service, iamService *iam.Service, proxyAdmin *proxy.Admin, proxyURL, proxiedHostname, project, zone, network, machineType, applicationImage string) (*Pool, error) {
-	log.Printf("Creating the VM pool in %q/%q", project, zone)
-	freeVMChan := make(chan *compute.Instance, vmChanSize)
+//
+// `preemptibleFraction` (0 to 1) is the share of targetFreeVMCount that
+// Fill provisions as preemptible (or equivalent spot) instances, which are
+// substantially cheaper but can be terminated by the provider at any time.
+// Callers are responsible for detecting a terminated VM that still owns a
+// user's disk and reassigning that disk to a fresh pool VM. A value of 0
+// means the pool is entirely standard instances.
+//
+// VMs are created round-robin across `zones`; if a zone is out of capacity,
+// `createVM` falls back to the next zone in the list rather than failing
+// the whole fill cycle.
+//
+// If `maxVMAge` is non-zero, it is a hard cap on how long any pool VM may
+// run (whether or not it has been assigned to a user) before it is rotated
+// out, e.g. so that VMs eventually pick up a patched image.
+//
+// `idleVMTTL` is how long a backend may sit idle, per proxyAdmin's notion
+// of idleness, before KillOldVMs reaps it; a zero value uses
+// defaultIdleVMTTL. This is distinct from `maxVMAge`, which is a hard cap
+// regardless of idleness.
+//
+// The number of free VMs the pool keeps on hand is demand-driven rather
+// than fixed: every fill cycle, targetFreeVMCount estimates how many VMs
+// will be needed to cover `warmupSeconds` worth of assignments at the
+// recent assignment rate, adds `minFreeVMBuffer` of slack, and clamps the
+// result to [`minFreeVMCount`, `maxFreeVMCount`].
+//
+// `subnetwork`, if non-empty, is attached to in place of letting `network`
+// pick one automatically; it may be a full shared-VPC reference (e.g.
+// "projects/<host-project>/regions/<region>/subnetworks/<name>"). If
+// `useInternalIPOnly` is set, pool VMs are created with no public IP, which
+// requires Private Google Access (or an equivalent NAT gateway) on
+// `subnetwork`. `agentImage`, if non-empty, overrides the default
+// proxy-agent image, e.g. with a private registry mirror reachable from a
+// `useInternalIPOnly` network.
+//
+// `stateStore` persists each VM's phase (free or assigned) across restarts;
+// NewPool uses it to reconcile the provider's live VM list before starting
+// Fill, so that a restart resumes free VMs and in-flight assignments
+// instead of either forgetting them or re-pushing an already-assigned VM
+// onto the free VM channel. A nil stateStore falls back to a
+// state.InMemoryStore, which does not survive a restart.
+func NewPool(ctx context.Context, provider providers.Provider, proxyAdmin *proxy.Admin, proxyURL, proxiedHostname, project string, zones []string, network, subnetwork string, useInternalIPOnly bool, machineType, applicationImage, agentImage string, preemptibleFraction float64, maxVMAge, idleVMTTL time.Duration, minFreeVMCount, maxFreeVMCount, minFreeVMBuffer int, warmupSeconds float64, stateStore state.StateStore) (*Pool, error) {
+	log.Printf("Creating the VM pool in %q across zones %v", project, zones)
+	if idleVMTTL <= 0 {
+		idleVMTTL = defaultIdleVMTTL
+	}
+	if stateStore == nil {
+		stateStore = state.NewInMemoryStore()
+	}
+	freeVMChan := make(chan *providers.Instance, vmChanSize)
 	pool := &Pool{
-		computeSvc:       computeService,
-		iamSvc:           iamService,
-		proxyAdmin:       proxyAdmin,
-		proxyURL:         proxyURL,
-		proxiedHostname:  proxiedHostname,
-		project:          project,
-		zone:             zone,
-		network:          network,
-		machineType:      machineType,
-		applicationImage: applicationImage,
-		freeVMChan:       freeVMChan,
+		provider:            provider,
+		proxyAdmin:          proxyAdmin,
+		stateStore:          stateStore,
+		proxyURL:            proxyURL,
+		proxiedHostname:     proxiedHostname,
+		project:             project,
+		zones:               zones,
+		network:             network,
+		subnetwork:          subnetwork,
+		useInternalIPOnly:   useInternalIPOnly,
+		machineType:         machineType,
+		applicationImage:    applicationImage,
+		agentImage:          agentImage,
+		preemptibleFraction: preemptibleFraction,
+		maxVMAge:            maxVMAge,
+		idleVMTTL:           idleVMTTL,
+		freeVMChan:          freeVMChan,
+		minFreeVMCount:      minFreeVMCount,
+		maxFreeVMCount:      maxFreeVMCount,
+		minFreeVMBuffer:     minFreeVMBuffer,
+		warmupSeconds:       warmupSeconds,
+	}
+
+	previouslySeenVMs := lru.New(vmCacheLimit)
+	if err := pool.reconcileState(ctx, previouslySeenVMs); err != nil {
+		return nil, fmt.Errorf("failed to reconcile the persisted pool state: %q", err.Error())
 	}
 	pool.Fill(ctx)
-	log.Printf("Finished creating the VM pool in %q/%q", project, zone)
+	log.Printf("Finished creating the VM pool in %q across zones %v", project, zones)
 
 	go func() {
-		previouslySeenVMs := lru.New(vmCacheLimit)
 		ticker := time.NewTicker(pollingInterval)
 		defer ticker.Stop()
 		for {
@@ -339,18 +385,18 @@ func NewPool(ctx context.Context, computeService *compute.Service, iamService *i
 					log.Printf("Error filling the free VM pool: %q", err.Error())
 				} else {
 					for _, vm := range vms {
-						if _, ok := previouslySeenVMs.Get(vm.Id); !ok {
-							previouslySeenVMs.Add(vm.Id, vm.Id)
+						if _, ok := previouslySeenVMs.Get(vm.ID); !ok {
+							previouslySeenVMs.Add(vm.ID, vm.ID)
 							freeVMChan <- vm
 						}
 					}
 				}
-				idleBackends, err := pool.proxyAdmin.IdleBackends(idleDuration)
+				idleBackends, err := pool.proxyAdmin.IdleBackends(pool.idleVMTTL)
 				if err != nil {
 					log.Printf("Error looking up the idle backendss: %q", err.Error())
 					idleBackends = []string{}
 				}
-				if err := pool.KillOldVMs(idleBackends); err != nil {
+				if err := pool.KillOldVMs(ctx, idleBackends); err != nil {
 					log.Printf("Error killing the old VMs: %q", err.Error())
 				}
 			}
@@ -359,14 +405,90 @@ func NewPool(ctx context.Context, computeService *compute.Service, iamService *i
 	return pool, nil
 }
 
+// recordAssignment notes that a VM was just assigned to a user, for use by
+// assignmentsPerSecond, and prunes entries that have fallen out of
+// assignmentWindow.
+func (p *Pool) recordAssignment(now time.Time) {
+	p.assignMu.Lock()
+	defer p.assignMu.Unlock()
+	p.assignTimes = append(p.assignTimes, now)
+	p.assignTimes = pruneBefore(p.assignTimes, now.Add(-assignmentWindow))
+}
+
+// assignmentsPerSecond returns the recent VM assignment rate, computed over
+// assignmentWindow.
+func (p *Pool) assignmentsPerSecond(now time.Time) float64 {
+	p.assignMu.Lock()
+	defer p.assignMu.Unlock()
+	p.assignTimes = pruneBefore(p.assignTimes, now.Add(-assignmentWindow))
+	return float64(len(p.assignTimes)) / assignmentWindow.Seconds()
+}
+
+// pruneBefore drops the leading entries of times (which is sorted, since
+// assignments are always appended in order) that are older than cutoff.
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// targetFreeVMCount estimates how many free VMs the pool should keep on
+// hand: enough to cover warmupSeconds of assignments at the recent
+// assignment rate, plus a fixed buffer, clamped to
+// [minFreeVMCount, maxFreeVMCount].
+func (p *Pool) targetFreeVMCount() int {
+	target := int(math.Ceil(p.assignmentsPerSecond(time.Now())*p.warmupSeconds)) + p.minFreeVMBuffer
+	if target < p.minFreeVMCount {
+		target = p.minFreeVMCount
+	}
+	if target > p.maxFreeVMCount {
+		target = p.maxFreeVMCount
+	}
+	return target
+}
+
+// Metrics reports the pool's current autoscaling state, for callers (e.g.
+// the HTTP layer) that want to surface it to operators.
+type Metrics struct {
+	// TargetFreeVMCount is the current demand-driven target computed by
+	// targetFreeVMCount.
+	TargetFreeVMCount int
+
+	// FreeVMCount is the number of unallocated VMs currently in the pool.
+	FreeVMCount int
+
+	// PendingWaitCount is the number of callers currently blocked in
+	// WaitForVM, waiting for a free VM to become available.
+	PendingWaitCount int
+
+	// AssignmentsPerMinute is the recent VM assignment rate.
+	AssignmentsPerMinute float64
+}
+
+// Metrics returns the pool's current autoscaling state.
+func (p *Pool) Metrics(ctx context.Context) (*Metrics, error) {
+	freeVMs, err := p.FreeVMs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Metrics{
+		TargetFreeVMCount:    p.targetFreeVMCount(),
+		FreeVMCount:          len(freeVMs),
+		PendingWaitCount:     int(atomic.LoadInt32(&p.pendingWaits)),
+		AssignmentsPerMinute: p.assignmentsPerSecond(time.Now()) * 60,
+	}, nil
+}
+
 // FreeVMs returns the list of unallocated VMs in the pool
-func (p *Pool) FreeVMs() ([]*compute.Instance, error) {
-	vms, err := p.computeSvc.Instances.List(p.project, p.zone).Do()
+func (p *Pool) FreeVMs(ctx context.Context) ([]*providers.Instance, error) {
+	vms, err := p.provider.List(ctx)
 	if err != nil {
 		return nil, err
 	}
-	var pooledVMs []*compute.Instance
-	for _, vm := range vms.Items {
+	var pooledVMs []*providers.Instance
+	for _, vm := range vms {
 		if isUnassigned(vm) {
 			pooledVMs = append(pooledVMs, vm)
 		}
@@ -375,14 +497,39 @@ func (p *Pool) FreeVMs() ([]*compute.Instance, error) {
 	return pooledVMs, nil
 }
 
-// Fill ensures that the pool contains the target number of free VMs.
-func (p *Pool) Fill(ctx context.Context) ([]*compute.Instance, error) {
-	vms, err := p.FreeVMs()
+// Fill ensures that the pool contains the target number of free VMs, split
+// between the preemptible and standard tiers according to
+// preemptibleFraction.
+func (p *Pool) Fill(ctx context.Context) ([]*providers.Instance, error) {
+	vms, err := p.FreeVMs(ctx)
 	if err != nil {
 		return nil, err
 	}
-	for i := len(vms); i < targetFreeVMCount; i++ {
-		vm, err := p.createVM(ctx)
+
+	var numPreemptible, numStandard int
+	for _, vm := range vms {
+		if vm.Preemptible {
+			numPreemptible++
+		} else {
+			numStandard++
+		}
+	}
+	total := p.targetFreeVMCount()
+	preemptibleTarget := int(float64(total) * p.preemptibleFraction)
+	standardTarget := total - preemptibleTarget
+
+	for i := numPreemptible; i < preemptibleTarget; i++ {
+		vm, err := p.createVM(ctx, true)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.proxyAdmin.RegisterBackend(vm, ""); err != nil {
+			return nil, err
+		}
+		vms = append(vms, vm)
+	}
+	for i := numStandard; i < standardTarget; i++ {
+		vm, err := p.createVM(ctx, false)
 		if err != nil {
 			return nil, err
 		}
@@ -394,178 +541,219 @@ func (p *Pool) Fill(ctx context.Context) ([]*compute.Instance, error) {
 	return vms, nil
 }
 
-// TooOldVMs computes the list of all VMs that are too old under three criteria:
+// TooOldVMs computes the list of all VMs that are too old under five criteria:
 //
 //   1. Having sat idle for too long (i.e. wasting money).
 //   2. Having been assigned to a user for too long (as a form of abuse prevention).
 //   3. Being unassigned and created too long ago (i.e. potentially running an out-of-date image).
-func (p *Pool) TooOldVMs(vms []*compute.Instance, idleBackends []string) ([]*compute.Instance, error) {
+//   4. Having run for longer than the pool's maxVMAge, regardless of assignment.
+//   5. Being a preemptible VM that has already been reclaimed by the provider.
+func (p *Pool) TooOldVMs(vms []*providers.Instance, idleBackends []string) ([]*providers.Instance, error) {
 	idleBackendMap := make(map[string]struct{})
 	for _, idleBackend := range idleBackends {
 		idleBackendMap[idleBackend] = struct{}{}
 	}
 
-	var tooOldVMs []*compute.Instance
+	var tooOldVMs []*providers.Instance
 	for _, vm := range vms {
-		if isIdle(vm, idleBackendMap) || assignedForTooLong(vm) || isOutOfDate(vm) {
+		if isIdle(vm, idleBackendMap) || assignedForTooLong(vm) || isOutOfDate(vm) || exceedsMaxAge(vm, p.maxVMAge) || isPreempted(vm) {
 			tooOldVMs = append(tooOldVMs, vm)
 		}
 	}
 	return tooOldVMs, nil
 }
 
-func (p *Pool) DeleteVM(vm *compute.Instance) error {
-	log.Printf("Deleting the VM %s/%s/%s", p.project, p.zone, vm.Name)
-	op, err := p.computeSvc.Instances.Delete(p.project, p.zone, vm.Name).Do()
-	if err != nil {
-		return fmt.Errorf("Failure deleting the instance %q: %q", vm.Name, err.Error())
-	}
-	if err := utils.WaitForZoneOperation(p.computeSvc, p.project, p.zone, op.Name, pollingInterval); err != nil {
-		return fmt.Errorf("Failure waiting for an instance delete operation: %q", err.Error())
-	}
-	for _, account := range vm.ServiceAccounts {
-		fullAccountName := fmt.Sprintf("projects/%s/serviceAccounts/%s", p.project, account.Email)
-		log.Printf("Deleting the service account %q", fullAccountName)
-		_, err := p.iamSvc.Projects.ServiceAccounts.Delete(fullAccountName).Do()
-		if err != nil {
-			return fmt.Errorf("Failed to delete the service account %q: %q", fullAccountName, err.Error())
+// DeleteVM unregisters vm's backend from the proxy and tells the provider
+// to tear it down (detaching its user disk along the way, if any, leaving
+// the disk itself intact for a fresh VM to pick up later).
+func (p *Pool) DeleteVM(ctx context.Context, vm *providers.Instance) error {
+	if backendID, ok := vm.Metadata[providers.BackendIDKey]; ok {
+		if err := p.proxyAdmin.UnregisterBackend(backendID); err != nil {
+			log.Printf("Failure unregistering the backend %q: %q", backendID, err.Error())
+		}
+		if err := p.stateStore.Delete(ctx, backendID); err != nil {
+			log.Printf("Failure clearing the persisted state for %q: %q", backendID, err.Error())
 		}
 	}
-	return nil
+	return p.provider.Delete(ctx, vm)
 }
 
-func (p *Pool) KillOldVMs(idleBackends []string) error {
-	vms, err := p.computeSvc.Instances.List(p.project, p.zone).Do()
+func (p *Pool) KillOldVMs(ctx context.Context, idleBackends []string) error {
+	vms, err := p.provider.List(ctx)
 	if err != nil {
 		return fmt.Errorf("Failure listing the VMs: %q", err.Error())
 	}
-	tooOldVMs, err := p.TooOldVMs(vms.Items, idleBackends)
+	tooOldVMs, err := p.TooOldVMs(vms, idleBackends)
 	if err != nil {
 		return fmt.Errorf("Failure identifying the `too-old` VMs: %q", err.Error())
 	}
 	for _, vm := range tooOldVMs {
 		log.Printf("Deleting too-old VM %q", vm.Name)
-		if err := p.DeleteVM(vm); err != nil {
+		if err := p.DeleteVM(ctx, vm); err != nil {
 			return fmt.Errorf("Failure deleting a `too-old` VMs: %q", err.Error())
 		}
 	}
 	return nil
 }
 
-// createConfig randomly generates a new VM configuration.
-//
-// This does not actually create the VM. That is done by the `createVM` method.
-func (pool *Pool) createConfig() (*Config, error) {
+// zoneOrder returns the pool's zones in round-robin order, rotating the
+// starting point on every call. This is the order in which createVM tries
+// zones when provisioning a new pool VM.
+func (pool *Pool) zoneOrder() []string {
+	pool.zoneIdxMu.Lock()
+	start := pool.nextZoneIdx
+	pool.nextZoneIdx = (pool.nextZoneIdx + 1) % len(pool.zones)
+	pool.zoneIdxMu.Unlock()
+
+	order := make([]string, 0, len(pool.zones))
+	for i := 0; i < len(pool.zones); i++ {
+		order = append(order, pool.zones[(start+i)%len(pool.zones)])
+	}
+	return order
+}
+
+func (pool *Pool) createVM(ctx context.Context, preemptible bool) (*providers.Instance, error) {
 	randInt, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
 	if err != nil {
 		return nil, err
 	}
 	backendID := randInt.Text(16)
 	instanceName := "user-vm-" + backendID
-	serviceAccountName := "sa-" + backendID
-	return &Config{
-		InstanceName:       instanceName,
-		ServiceAccountName: serviceAccountName,
-		ProxyURL:           pool.proxyURL,
-		ApplicationImage:   pool.applicationImage,
-		BackendID:          backendID,
-		ProxiedHostname:    pool.proxiedHostname,
-	}, nil
-}
 
-func (pool *Pool) createVM(ctx context.Context) (*compute.Instance, error) {
-	config, err := pool.createConfig()
-	if err != nil {
-		return nil, err
-	}
-	metadata, err := config.getMetadata()
+	serviceAccountEmail, err := pool.provider.RegisterServiceIdentity(ctx, instanceName)
 	if err != nil {
 		return nil, err
 	}
 
-	instanceDescription := "User VM"
-	serviceAccountDescription := fmt.Sprintf("Service account for the VM %q", config.InstanceName)
+	cfg := providers.Config{
+		Name:                instanceName,
+		ServiceAccountEmail: serviceAccountEmail,
+		MachineType:         pool.machineType,
+		Network:             pool.network,
+		Subnetwork:          pool.subnetwork,
+		UseInternalIPOnly:   pool.useInternalIPOnly,
+		BootDiskSizeGB:      userVMBootDiskSizeGB,
+		Preemptible:         preemptible,
+		ProxyURL:            pool.proxyURL,
+		ApplicationImage:    pool.applicationImage,
+		BackendID:           backendID,
+		ProxiedHostname:     pool.proxiedHostname,
+		AgentImage:          pool.agentImage,
+	}
+
+	var instance *providers.Instance
+	var lastErr error
+	for _, zone := range pool.zoneOrder() {
+		cfg.Zone = zone
+		log.Printf("Creating the VM %s/%s/%s", pool.project, zone, instanceName)
+		created, err := pool.provider.Create(ctx, cfg)
+		if err != nil {
+			if pool.provider.IsStockoutError(err) {
+				log.Printf("Zone %q is out of capacity, trying the next zone", zone)
+				lastErr = err
+				continue
+			}
+			return nil, err
+		}
+		instance = created
+		break
+	}
+	if instance == nil {
+		return nil, fmt.Errorf("failed to create a pool VM in any zone: %v", lastErr)
+	}
 
-	log.Printf("Creating the service account %s", config.ServiceAccountName)
-	serviceAccount, err := pool.iamSvc.Projects.ServiceAccounts.Create(
-		"projects/"+pool.project,
-		&iam.CreateServiceAccountRequest{
-			AccountId: config.ServiceAccountName,
-			ServiceAccount: &iam.ServiceAccount{
-				DisplayName: serviceAccountDescription,
-			},
-		}).Do()
+	log.Printf("Waiting for the VM %s/%s/%s to start running", pool.project, instance.Zone, instance.Name)
+	running, err := pool.provider.WaitRunning(ctx, instance)
 	if err != nil {
+		pool.provider.Delete(ctx, instance)
 		return nil, err
 	}
+	if err := pool.stateStore.Put(ctx, state.Record{BackendID: backendID, Phase: state.PhaseFree, Zone: running.Zone}); err != nil {
+		log.Printf("Failed to persist the pool state for %q: %q", running.Name, err.Error())
+	}
+	return running, nil
+}
 
-	log.Printf("Creating the VM %s/%s/%s", pool.project, pool.zone, config.InstanceName)
-	if err := utils.CreateVM(pool.computeSvc, pool.project, pool.zone,
-		config.InstanceName, instanceDescription, pool.machineType, pool.network,
-		serviceAccount.Email, 20, metadata, pollingInterval); err != nil {
-		return nil, err
+// assignVM marks vm as assigned to userEmail. The state-store write happens
+// before the provider.SetMetadata call, so it doubles as an operation log:
+// if the process crashes in between, reconcileState finds a VM whose
+// persisted state says "assigned" but whose live metadata still says
+// otherwise, and knows to discard the stale record rather than believing an
+// assignment that never actually completed.
+func (pool *Pool) assignVM(ctx context.Context, vm *providers.Instance, userEmail string) error {
+	now := time.Now()
+	backendID := vm.Metadata[providers.BackendIDKey]
+	if err := pool.stateStore.Put(ctx, state.Record{
+		BackendID:  backendID,
+		Phase:      state.PhaseAssigned,
+		Zone:       vm.Zone,
+		ForUser:    userEmail,
+		AssignedAt: now,
+	}); err != nil {
+		return err
 	}
-	log.Printf("Waiting for the VM %s/%s/%s to start running", pool.project, pool.zone, config.InstanceName)
-	instanceGetCall := pool.computeSvc.Instances.Get(pool.project, pool.zone, config.InstanceName)
-	for {
-		instance, err := instanceGetCall.Do()
-		if err != nil {
-			pool.DeleteVM(instance)
-			return nil, err
-		}
-		if instance.Status == "RUNNING" {
-			return instance, nil
-		}
-		if instance.Status != "PROVISIONING" && instance.Status != "STAGING" {
-			pool.DeleteVM(instance)
-			return nil, fmt.Errorf("Unexpected instance status: %q", instance.Status)
-		}
-		time.Sleep(pollingInterval)
+	metadata := map[string]string{
+		providers.ForUserKey:          userEmail,
+		providers.ForUserTimestampKey: now.Format(time.RFC3339),
 	}
+	return pool.provider.SetMetadata(ctx, vm, metadata)
 }
 
-func (pool *Pool) assignVM(vm *compute.Instance, userEmail string) error {
-	var updatedItems []*compute.MetadataItems
-	for _, item := range vm.Metadata.Items {
-		if item.Key != forUserKey && item.Key != forUserTimestampKey {
-			updatedItems = append(updatedItems, item)
+// sameZoneVM does a non-blocking scan of the free VM channel for an
+// instance in preferredZone, requeueing every other-zone instance it has to
+// pull out along the way. It returns nil if no such instance is
+// immediately available.
+func (pool *Pool) sameZoneVM(preferredZone string) *providers.Instance {
+	var match *providers.Instance
+	var deferred []*providers.Instance
+scan:
+	for {
+		select {
+		case vm := <-pool.freeVMChan:
+			if vm.Zone == preferredZone {
+				match = vm
+				break scan
+			}
+			deferred = append(deferred, vm)
+		default:
+			break scan
 		}
 	}
-	forUserItem := &compute.MetadataItems{
-		Key:   forUserKey,
-		Value: &userEmail,
+	for _, vm := range deferred {
+		pool.freeVMChan <- vm
 	}
-	timestamp := time.Now().Format(time.RFC3339)
-	forUserTimestampItem := &compute.MetadataItems{
-		Key:   forUserTimestampKey,
-		Value: &timestamp,
-	}
-	updatedItems = append(updatedItems, forUserItem, forUserTimestampItem)
-	op, err := pool.computeSvc.Instances.SetMetadata(pool.project, pool.zone, vm.Name, &compute.Metadata{
-		Fingerprint: vm.Metadata.Fingerprint,
-		Items:       updatedItems,
-	}).Do()
-	if err != nil {
-		return err
-	}
-	return utils.WaitForZoneOperation(pool.computeSvc, pool.project, pool.zone, op.Name, pollingInterval)
+	return match
 }
 
-func (pool *Pool) WaitForVM(ctx context.Context, userEmail string) (*compute.Instance, error) {
-	log.Print("Waiting for a new VM from the pool")
+// WaitForVM waits for a free VM to assign to userEmail, preferring one
+// already in preferredZone (e.g. the zone of the user's persistent disk) so
+// that the caller can attach the disk without hitting a cross-zone error.
+// An empty preferredZone means any zone is acceptable.
+func (pool *Pool) WaitForVM(ctx context.Context, userEmail, preferredZone string) (*providers.Instance, error) {
+	log.Printf("Waiting for a new VM from the pool (preferred zone %q)", preferredZone)
+
+	atomic.AddInt32(&pool.pendingWaits, 1)
+	defer atomic.AddInt32(&pool.pendingWaits, -1)
 
 	timer := time.NewTimer(vmWaitTimeout)
 	for i := 0; i < assignAttemptLimit; i++ {
-		select {
-		case vm := <-pool.freeVMChan:
-			if err := pool.assignVM(vm, userEmail); err != nil {
-				log.Printf("Error assigning a VM: %q, %q", vm.Name, err.Error())
-				continue
+		var vm *providers.Instance
+		if preferredZone != "" {
+			vm = pool.sameZoneVM(preferredZone)
+		}
+		if vm == nil {
+			select {
+			case vm = <-pool.freeVMChan:
+			case <-timer.C:
+				return nil, errors.New("Timeout waiting for a free VM")
 			}
-			return vm, nil
-		case <-timer.C:
-			return nil, errors.New("Timeout waiting for a free VM")
 		}
+		if err := pool.assignVM(ctx, vm, userEmail); err != nil {
+			log.Printf("Error assigning a VM: %q, %q", vm.Name, err.Error())
+			continue
+		}
+		pool.recordAssignment(time.Now())
+		return vm, nil
 	}
 	return nil, fmt.Errorf("Exceeded VM assignment retry limit: %d", assignAttemptLimit)
 }
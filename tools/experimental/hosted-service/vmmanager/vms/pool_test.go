@@ -0,0 +1,117 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vms
+
+import (
+	"testing"
+	"time"
+
+	"vm-manager/vms/providers"
+)
+
+func unassignedVM(created time.Time, preemptible bool) *providers.Instance {
+	return &providers.Instance{
+		Created:     created,
+		Preemptible: preemptible,
+		Metadata:    map[string]string{providers.ForUserKey: ""},
+	}
+}
+
+func TestIsOutOfDateUnassigned(t *testing.T) {
+	now := time.Now()
+
+	if isOutOfDate(unassignedVM(now, false)) {
+		t.Error("a freshly created standard VM should not be out of date")
+	}
+	if !isOutOfDate(unassignedVM(now.Add(-standardCreationTimeLimit-time.Minute), false)) {
+		t.Error("a standard VM older than standardCreationTimeLimit should be out of date")
+	}
+	if isOutOfDate(unassignedVM(now.Add(-preemptibleCreationTimeLimit+time.Minute), true)) {
+		t.Error("a preemptible VM younger than preemptibleCreationTimeLimit should not be out of date")
+	}
+	if !isOutOfDate(unassignedVM(now.Add(-preemptibleCreationTimeLimit-time.Minute), true)) {
+		t.Error("a preemptible VM older than preemptibleCreationTimeLimit should be out of date")
+	}
+}
+
+func TestIsOutOfDateIgnoresAssignedVMs(t *testing.T) {
+	// An assigned VM (forUser non-empty) has its own expiration policy via
+	// assignedForTooLong, not isOutOfDate, regardless of its age.
+	vm := &providers.Instance{
+		Created:  time.Now().Add(-10 * 365 * 24 * time.Hour),
+		Metadata: map[string]string{providers.ForUserKey: "alice@example.com"},
+	}
+	if isOutOfDate(vm) {
+		t.Error("isOutOfDate should not apply to an assigned VM")
+	}
+}
+
+func TestExceedsMaxAge(t *testing.T) {
+	vm := &providers.Instance{Created: time.Now().Add(-2 * time.Hour)}
+
+	if exceedsMaxAge(vm, 0) {
+		t.Error("a zero maxAge should disable the cap")
+	}
+	if exceedsMaxAge(vm, 3*time.Hour) {
+		t.Error("a VM younger than maxAge should not exceed it")
+	}
+	if !exceedsMaxAge(vm, time.Hour) {
+		t.Error("a VM older than maxAge should exceed it")
+	}
+}
+
+func TestIsPreempted(t *testing.T) {
+	if isPreempted(&providers.Instance{Preemptible: false, Status: "TERMINATED"}) {
+		t.Error("a standard (non-preemptible) VM cannot be 'preempted'")
+	}
+	if isPreempted(&providers.Instance{Preemptible: true, Status: "RUNNING"}) {
+		t.Error("a running preemptible VM has not been preempted")
+	}
+	if !isPreempted(&providers.Instance{Preemptible: true, Status: "TERMINATED"}) {
+		t.Error("a terminated preemptible VM should be reported as preempted")
+	}
+}
+
+func TestTargetFreeVMCountClampsToRange(t *testing.T) {
+	p := &Pool{minFreeVMCount: 2, maxFreeVMCount: 10, minFreeVMBuffer: 1, warmupSeconds: 30}
+
+	if got, want := p.targetFreeVMCount(), 2; got != want {
+		t.Errorf("with no recent assignments, got target %d, want the minimum %d", got, want)
+	}
+
+	now := time.Now()
+	// 1000 assignments over the 5-minute window is ~3.3/s; with 30s of
+	// warmup that estimates ~100 VMs, well above maxFreeVMCount.
+	for i := 0; i < 1000; i++ {
+		p.assignTimes = append(p.assignTimes, now)
+	}
+	if got, want := p.targetFreeVMCount(), 10; got != want {
+		t.Errorf("with heavy recent demand, got target %d, want it clamped to the maximum %d", got, want)
+	}
+}
+
+func TestTargetFreeVMCountScalesWithDemand(t *testing.T) {
+	p := &Pool{minFreeVMCount: 0, maxFreeVMCount: 100, minFreeVMBuffer: 0, warmupSeconds: assignmentWindow.Seconds()}
+
+	now := time.Now()
+	p.assignTimes = []time.Time{now, now}
+	// Two assignments over the full assignmentWindow, warmupSeconds equal
+	// to the window, so the target should cover those two assignments.
+	if got, want := p.targetFreeVMCount(), 2; got != want {
+		t.Errorf("got target %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,348 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package azure implements providers.Provider for Microsoft Azure.
+//
+// A backend VM is represented by two Azure resources created together: a
+// network interface and the virtual machine itself. Both share the VM's
+// name as a prefix so that Delete can find and remove them without needing
+// any extra bookkeeping. No managed identity is created per VM in place of
+// a GCE-style service account; RegisterServiceIdentity returns "".
+package azure
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/compute"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/network"
+	"github.com/Azure/go-autorest/autorest/to"
+	"golang.org/x/net/context"
+
+	"vm-manager/vms/providers"
+)
+
+// Provider implements providers.Provider for Microsoft Azure.
+type Provider struct {
+	vmClient  compute.VirtualMachinesClient
+	nicClient network.InterfacesClient
+	subnetID  string
+	location  string
+
+	resourceGroup string
+}
+
+// New returns a Provider that manages backend VMs in the given resource
+// group/location, attaching their NICs to the given subnet.
+//
+// `subscriptionID` identifies the Azure subscription to bill and to create
+// resources in; authentication is expected to already be configured via the
+// environment (AZURE_* variables).
+func New(subscriptionID, resourceGroup, location, subnetID string) (*Provider, error) {
+	vmClient := compute.NewVirtualMachinesClient(subscriptionID)
+	nicClient := network.NewInterfacesClient(subscriptionID)
+	return &Provider{
+		vmClient:      vmClient,
+		nicClient:     nicClient,
+		subnetID:      subnetID,
+		location:      location,
+		resourceGroup: resourceGroup,
+	}, nil
+}
+
+func nicName(vmName string) string { return vmName + "-nic" }
+
+// tagsFromMetadata converts a providers.Instance-style metadata map into
+// the map[string]*string shape the Azure VM "tags" field requires, which is
+// how this provider persists providers.BackendIDKey/ForUserKey/
+// ForUserTimestampKey so that they survive a List()/WaitRunning() refetch.
+func tagsFromMetadata(metadata map[string]string) map[string]*string {
+	tags := make(map[string]*string, len(metadata))
+	for k, v := range metadata {
+		value := v
+		tags[k] = &value
+	}
+	return tags
+}
+
+// metadataFromTags is the inverse of tagsFromMetadata, used by toInstance to
+// reconstruct an Instance's Metadata from a VM's tags.
+func metadataFromTags(tags map[string]*string) map[string]string {
+	metadata := make(map[string]string, len(tags))
+	for k, v := range tags {
+		if v != nil {
+			metadata[k] = *v
+		}
+	}
+	return metadata
+}
+
+// createdTagKey stores a VM's creation time, as an RFC3339 string, in an
+// Azure tag. Unlike GCE's CreationTimestamp or OpenStack's server.Created,
+// Azure exposes no creation timestamp of its own, but vms.Pool's
+// isOutOfDate/exceedsMaxAge checks rely on Instance.Created being accurate
+// to decide whether a pool VM is due for replacement; Create stamps this
+// tag so toInstance can read it back instead of always reporting the zero
+// time (which isOutOfDate would read as decades old, reaping every VM
+// before it could ever be assigned).
+const createdTagKey = "vm-manager-created"
+
+// createdFromTags parses the tag that Create stamps with createdTagKey. It
+// returns the zero Time for a VM with no such tag (e.g. one created before
+// this field existed), the same fallback Instance.Created already had.
+func createdFromTags(tags map[string]*string) time.Time {
+	v, ok := tags[createdTagKey]
+	if !ok || v == nil {
+		return time.Time{}
+	}
+	created, err := time.Parse(time.RFC3339, *v)
+	if err != nil {
+		return time.Time{}
+	}
+	return created
+}
+
+// customData renders the cloud-init `user_data` payload used to bootstrap
+// the backend and proxy-agent containers, base64-encoded as the Azure VM
+// extension API requires.
+func customData(cfg providers.Config) string {
+	agentImage := cfg.AgentImage
+	if agentImage == "" {
+		agentImage = "gcr.io/inverting-proxy/agent"
+	}
+	script := fmt.Sprintf(`#!/bin/bash
+mkdir -p /mnt/disks/user-pd
+mount -o discard,defaults /dev/disk/azure/scsi1/lun0 /mnt/disks/user-pd || true
+docker pull %s
+docker pull %s
+docker run -d --rm --name=backend -p 127.0.0.1:8080:8080 -v /mnt/disks/user-pd:/content --hostname %q %s
+docker run -d --rm --name=agent --net=host --env=BACKEND=%q --env=PROXY=%q %s
+`, agentImage, cfg.ApplicationImage, cfg.ProxiedHostname, cfg.ApplicationImage, cfg.BackendID, cfg.ProxyURL, agentImage)
+	return base64.StdEncoding.EncodeToString([]byte(script))
+}
+
+func (p *Provider) createNIC(ctx context.Context, vmName string) (network.Interface, error) {
+	future, err := p.nicClient.CreateOrUpdate(ctx, p.resourceGroup, nicName(vmName), network.Interface{
+		Location: to.StringPtr(p.location),
+		InterfacePropertiesFormat: &network.InterfacePropertiesFormat{
+			IPConfigurations: &[]network.InterfaceIPConfiguration{
+				{
+					Name: to.StringPtr("ipconfig1"),
+					InterfaceIPConfigurationPropertiesFormat: &network.InterfaceIPConfigurationPropertiesFormat{
+						Subnet: &network.Subnet{ID: to.StringPtr(p.subnetID)},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return network.Interface{}, err
+	}
+	if err := future.WaitForCompletionRef(ctx, p.nicClient.Client); err != nil {
+		return network.Interface{}, err
+	}
+	return future.Result(p.nicClient)
+}
+
+func (p *Provider) Create(ctx context.Context, cfg providers.Config) (*providers.Instance, error) {
+	nic, err := p.createNIC(ctx, cfg.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the network interface for %q: %v", cfg.Name, err)
+	}
+
+	priority := compute.Regular
+	evictionPolicy := compute.VirtualMachineEvictionPolicyTypesDeallocate
+	if cfg.Preemptible {
+		priority = compute.Spot
+	}
+
+	initialTags := tagsFromMetadata(map[string]string{
+		providers.BackendIDKey: cfg.BackendID,
+		providers.ForUserKey:   "",
+		createdTagKey:          time.Now().UTC().Format(time.RFC3339),
+	})
+
+	log.Printf("Creating the VM %s/%s", p.resourceGroup, cfg.Name)
+	future, err := p.vmClient.CreateOrUpdate(ctx, p.resourceGroup, cfg.Name, compute.VirtualMachine{
+		Location: to.StringPtr(p.location),
+		Tags:     initialTags,
+		VirtualMachineProperties: &compute.VirtualMachineProperties{
+			Priority:       priority,
+			EvictionPolicy: evictionPolicy,
+			HardwareProfile: &compute.HardwareProfile{
+				VMSize: compute.VirtualMachineSizeTypes(cfg.MachineType),
+			},
+			StorageProfile: &compute.StorageProfile{
+				ImageReference: &compute.ImageReference{
+					Publisher: to.StringPtr("cos-cloud"),
+					Offer:     to.StringPtr("cos-stable"),
+					Sku:       to.StringPtr("stable"),
+					Version:   to.StringPtr("latest"),
+				},
+				OsDisk: &compute.OSDisk{
+					CreateOption: compute.DiskCreateOptionTypesFromImage,
+					DiskSizeGB:   to.Int32Ptr(int32(cfg.BootDiskSizeGB)),
+				},
+			},
+			OsProfile: &compute.OSProfile{
+				ComputerName:  to.StringPtr(cfg.Name),
+				CustomData:    to.StringPtr(customData(cfg)),
+				AdminUsername: to.StringPtr("backend"),
+			},
+			NetworkProfile: &compute.NetworkProfile{
+				NetworkInterfaces: &[]compute.NetworkInterfaceReference{
+					{ID: nic.ID},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := future.WaitForCompletionRef(ctx, p.vmClient.Client); err != nil {
+		return nil, err
+	}
+	vm, err := future.Result(p.vmClient)
+	if err != nil {
+		return nil, err
+	}
+	return p.toInstance(&vm, cfg.Zone), nil
+}
+
+// powerStateDeallocated matches the "PowerState/deallocated" status code
+// that Azure reports in a VM's instance view once it has been stopped,
+// whether by the user or (for a Spot VM) by an eviction.
+const powerStateDeallocated = "PowerState/deallocated"
+
+func (p *Provider) toInstance(vm *compute.VirtualMachine, zone string) *providers.Instance {
+	status := "PROVISIONING"
+	var preemptible bool
+	if vm.VirtualMachineProperties != nil {
+		if vm.VirtualMachineProperties.ProvisioningState != nil && strings.EqualFold(*vm.VirtualMachineProperties.ProvisioningState, "Succeeded") {
+			status = "RUNNING"
+		}
+		preemptible = vm.VirtualMachineProperties.Priority == compute.Spot
+		if iv := vm.VirtualMachineProperties.InstanceView; iv != nil && iv.Statuses != nil {
+			for _, s := range *iv.Statuses {
+				if s.Code != nil && *s.Code == powerStateDeallocated {
+					// Mirrors the GCE convention so that vms.Pool's
+					// preemption detection works the same way regardless
+					// of provider.
+					status = "TERMINATED"
+				}
+			}
+		}
+	}
+	return &providers.Instance{
+		ID:          to.String(vm.VMID),
+		Name:        to.String(vm.Name),
+		Zone:        zone,
+		Status:      status,
+		Created:     createdFromTags(vm.Tags),
+		Metadata:    metadataFromTags(vm.Tags),
+		Preemptible: preemptible,
+	}
+}
+
+func (p *Provider) List(ctx context.Context) ([]*providers.Instance, error) {
+	// ListComplete does not return instance views, so eviction of a Spot VM
+	// is only surfaced here once its provisioning state itself changes;
+	// WaitRunning, which does request the instance view, is the more
+	// reliable place to detect a deallocated VM promptly.
+	var all []*providers.Instance
+	iter, err := p.vmClient.ListComplete(ctx, p.resourceGroup)
+	if err != nil {
+		return nil, err
+	}
+	for iter.NotDone() {
+		vm := iter.Value()
+		all = append(all, p.toInstance(&vm, p.location))
+		if err := iter.NextWithContext(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return all, nil
+}
+
+func (p *Provider) WaitRunning(ctx context.Context, instance *providers.Instance) (*providers.Instance, error) {
+	for {
+		vm, err := p.vmClient.Get(ctx, p.resourceGroup, instance.Name, compute.InstanceView)
+		if err != nil {
+			return nil, err
+		}
+		updated := p.toInstance(&vm, instance.Zone)
+		if updated.Status == "RUNNING" {
+			return updated, nil
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// SetMetadata merges metadata into instance's VM tags, Azure's closest
+// equivalent to GCE instance metadata, so that the assignment bookkeeping
+// Pool relies on (providers.ForUserKey/ForUserTimestampKey) survives the
+// next List()/WaitRunning() refetch instead of being thrown away as soon as
+// the in-memory Instance is rebuilt from a fresh API response.
+func (p *Provider) SetMetadata(ctx context.Context, instance *providers.Instance, metadata map[string]string) error {
+	merged := make(map[string]string, len(instance.Metadata)+len(metadata))
+	for k, v := range instance.Metadata {
+		merged[k] = v
+	}
+	for k, v := range metadata {
+		merged[k] = v
+	}
+	future, err := p.vmClient.Update(ctx, p.resourceGroup, instance.Name, compute.VirtualMachineUpdate{
+		Tags: tagsFromMetadata(merged),
+	})
+	if err != nil {
+		return err
+	}
+	if err := future.WaitForCompletionRef(ctx, p.vmClient.Client); err != nil {
+		return err
+	}
+	instance.Metadata = merged
+	return nil
+}
+
+func (p *Provider) RegisterServiceIdentity(ctx context.Context, name string) (string, error) {
+	// User-assigned managed identities are provisioned out of band by the
+	// operator and referenced by name; there is nothing to create here.
+	return "", nil
+}
+
+func (p *Provider) Delete(ctx context.Context, instance *providers.Instance) error {
+	log.Printf("Deleting the VM %s/%s", p.resourceGroup, instance.Name)
+	vmFuture, err := p.vmClient.Delete(ctx, p.resourceGroup, instance.Name)
+	if err != nil {
+		return fmt.Errorf("failed to delete the instance %q: %v", instance.Name, err)
+	}
+	if err := vmFuture.WaitForCompletionRef(ctx, p.vmClient.Client); err != nil {
+		return fmt.Errorf("failed waiting for the instance %q to be deleted: %v", instance.Name, err)
+	}
+
+	nicFuture, err := p.nicClient.Delete(ctx, p.resourceGroup, nicName(instance.Name))
+	if err != nil {
+		return fmt.Errorf("failed to delete the network interface for %q: %v", instance.Name, err)
+	}
+	return nicFuture.WaitForCompletionRef(ctx, p.nicClient.Client)
+}
+
+func (p *Provider) IsStockoutError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "SkuNotAvailable")
+}
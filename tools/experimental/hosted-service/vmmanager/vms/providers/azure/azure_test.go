@@ -0,0 +1,81 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azure
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/compute"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+func TestToInstanceRoundTripsTagsAndCreatedTime(t *testing.T) {
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	vm := &compute.VirtualMachine{
+		VMID: to.StringPtr("vm-id-1"),
+		Name: to.StringPtr("test-vm"),
+		Tags: tagsFromMetadata(map[string]string{
+			"backend-id":  "backend-1",
+			"for-user":    "alice@example.com",
+			createdTagKey: created.Format(time.RFC3339),
+		}),
+		VirtualMachineProperties: &compute.VirtualMachineProperties{
+			ProvisioningState: to.StringPtr("Succeeded"),
+			Priority:          compute.Spot,
+		},
+	}
+
+	p := &Provider{}
+	instance := p.toInstance(vm, "eastus")
+
+	if instance.ID != "vm-id-1" {
+		t.Errorf("got ID %q, want %q", instance.ID, "vm-id-1")
+	}
+	if instance.Name != "test-vm" {
+		t.Errorf("got Name %q, want %q", instance.Name, "test-vm")
+	}
+	if instance.Zone != "eastus" {
+		t.Errorf("got Zone %q, want %q", instance.Zone, "eastus")
+	}
+	if instance.Status != "RUNNING" {
+		t.Errorf("got Status %q, want %q", instance.Status, "RUNNING")
+	}
+	if !instance.Preemptible {
+		t.Error("got Preemptible = false, want true for a Spot VM")
+	}
+	if !instance.Created.Equal(created) {
+		t.Errorf("got Created %v, want %v", instance.Created, created)
+	}
+	if got := instance.Metadata["for-user"]; got != "alice@example.com" {
+		t.Errorf("got for-user metadata %q, want %q", got, "alice@example.com")
+	}
+}
+
+func TestToInstanceCreatedIsZeroWithoutTag(t *testing.T) {
+	vm := &compute.VirtualMachine{
+		VMID: to.StringPtr("vm-id-2"),
+		Name: to.StringPtr("legacy-vm"),
+	}
+
+	p := &Provider{}
+	instance := p.toInstance(vm, "eastus")
+
+	if !instance.Created.IsZero() {
+		t.Errorf("got Created %v, want the zero time for a VM with no creation tag", instance.Created)
+	}
+}
@@ -0,0 +1,400 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package gce implements providers.Provider for Google Compute Engine.
+package gce
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+	iam "google.golang.org/api/iam/v1"
+
+	"vm-manager/utils"
+	"vm-manager/vms/providers"
+)
+
+const pollingInterval = 10 * time.Millisecond
+
+// defaultAgentImage is the proxy-agent image pulled when Config.AgentImage
+// is unset. Deployments with no public egress (UseInternalIPOnly) must set
+// Config.AgentImage to a mirror reachable from inside their VPC instead.
+const defaultAgentImage = "gcr.io/inverting-proxy/agent"
+
+var cloudConfigTmplText = `#cloud-config
+users:
+- name: backend
+  uid: 2000
+  groups: docker
+- name: agent
+  uid: 2001
+  groups: docker
+
+write_files:
+- path: /etc/systemd/system/waitfordiskready.sh
+  permissions: 0744
+  owner: root
+  content: |
+    PERSISTENT_DISK_DEV="/dev/disk/by-id/google-user-pd"
+    MOUNT_DIR="/mnt/disks/user-pd"
+    MOUNT_CMD="mount -o discard,defaults ${PERSISTENT_DISK_DEV} ${MOUNT_DIR}"
+
+    wait_for_disk() {
+      echo "Waiting for the persistent disk to be attached"
+      while [ ! -e "${PERSISTENT_DISK_DEV}" ]; do
+        sleep 1
+      done
+      echo "The persistent disk has been attached"
+    }
+
+    mount_disk() {
+      if mount | grep "${MOUNT_DIR}" > /dev/null; then
+        echo "The persistent disk has already been mounted"
+      else
+        echo "Mounting the persistent disk"
+        mkdir -p "${MOUNT_DIR}"
+        ${MOUNT_CMD}
+      fi
+    }
+    wait_for_disk
+    mount_disk
+
+- path: /etc/systemd/system/pullimages.sh
+  permissions: 0744
+  owner: root
+  content: |
+    docker pull {{.AgentImage}}
+    docker pull {{.ApplicationImage}}
+
+- path: /etc/systemd/system/waitfordisk.service
+  permissions: 0644
+  owner: root
+  content: |
+    [Unit]
+    Description=wait for disk
+    Requires=network-online.target
+    After=network-online.target setup.service
+
+    [Service]
+    Type=oneshot
+    ExecStart=/bin/bash /etc/systemd/system/waitfordiskready.sh
+
+- path: /etc/systemd/system/pullimages.service
+  permissions: 0644
+  owner: root
+  content: |
+    [Unit]
+    Description=pull docker images
+    Requires=network-online.target
+    After=network-online.target setup.service
+
+    [Service]
+    Type=oneshot
+    ExecStart=/bin/bash /etc/systemd/system/pullimages.sh
+
+- path: /etc/systemd/system/backend.service
+  permissions: 0644
+  owner: root
+  content: |
+    [Unit]
+    Description=backend docker container
+    Requires=network-online.target waitfordisk.service
+    After=network-online.target waitfordisk.service
+    [Service]
+    ExecStartPre=-/usr/bin/docker rm -fv backend
+    ExecStart=/usr/bin/docker run --rm \
+        --name=backend \
+        -p 127.0.0.1:8080:8080 \
+        -v /mnt/disks/user-pd:/content \
+        --hostname "{{.ProxiedHostname}}" \
+        --env=CLOUD_SDK_CORE_PROJECT="" \
+        --env=NO_GCE_CHECK="True" \
+        {{.ApplicationImage}}
+    Restart=always
+    RestartSec=1
+
+- path: /etc/systemd/system/agent.service
+  permissions: 0644
+  owner: root
+  content: |
+    [Unit]
+    Description=proxy agent docker container
+    Requires=network-online.target waitfordisk.service
+    After=network-online.target waitfordisk.service
+
+    [Service]
+    Environment="HOME=/home/agent"
+    ExecStartPre=-/usr/bin/docker rm -fv agent
+    ExecStart=/usr/bin/docker -D run --net=host -t --rm -u 0 \
+       --name=agent \
+       --env="BACKEND={{.BackendID}}" \
+       --env="PROXY={{.ProxyURL}}" \
+       {{.AgentImage}}
+    Restart=always
+    RestartSec=1
+
+runcmd:
+- systemctl daemon-reload
+- systemctl start pullimages.service
+- systemctl start waitfordisk.service
+- systemctl start backend.service
+- systemctl start agent.service
+`
+
+func renderCloudConfig(cfg providers.Config) (string, error) {
+	if cfg.AgentImage == "" {
+		cfg.AgentImage = defaultAgentImage
+	}
+	t := template.Must(template.New("cloud-config").Parse(cloudConfigTmplText))
+	var b bytes.Buffer
+	if err := t.Execute(&b, cfg); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Provider implements providers.Provider for Google Compute Engine.
+type Provider struct {
+	computeSvc *compute.Service
+	iamSvc     *iam.Service
+	project    string
+	zones      []string
+}
+
+// New returns a Provider that manages backend VMs in the given project,
+// spread across the given zones.
+func New(computeSvc *compute.Service, iamSvc *iam.Service, project string, zones []string) *Provider {
+	return &Provider{
+		computeSvc: computeSvc,
+		iamSvc:     iamSvc,
+		project:    project,
+		zones:      zones,
+	}
+}
+
+// ToInstance converts a raw Compute Engine instance into the provider-
+// agnostic Instance representation. It is exported so that callers that
+// still deal directly with *compute.Instance (e.g. when attaching a user's
+// disk) can hand the result to the rest of the Pool/proxy machinery.
+func ToInstance(vm *compute.Instance) *providers.Instance {
+	zone := vm.Zone[strings.LastIndex(vm.Zone, "/")+1:]
+
+	metadata := make(map[string]string)
+	if vm.Metadata != nil {
+		for _, item := range vm.Metadata.Items {
+			if item.Value != nil {
+				metadata[item.Key] = *item.Value
+			}
+		}
+	}
+
+	created, err := time.Parse(time.RFC3339, vm.CreationTimestamp)
+	if err != nil {
+		log.Printf("Malformed creation timestamp for %q: %q", vm.Name, err.Error())
+	}
+
+	var serviceAccountEmail string
+	if len(vm.ServiceAccounts) > 0 {
+		serviceAccountEmail = vm.ServiceAccounts[0].Email
+	}
+
+	var preemptible bool
+	if vm.Scheduling != nil {
+		preemptible = vm.Scheduling.Preemptible
+	}
+
+	return &providers.Instance{
+		ID:                  fmt.Sprintf("%d", vm.Id),
+		Name:                vm.Name,
+		Zone:                zone,
+		Status:              vm.Status,
+		Created:             created,
+		Metadata:            metadata,
+		HasExtraDisk:        len(vm.Disks) > 1,
+		Preemptible:         preemptible,
+		ServiceAccountEmail: serviceAccountEmail,
+	}
+}
+
+func (p *Provider) List(ctx context.Context) ([]*providers.Instance, error) {
+	var all []*providers.Instance
+	for _, zone := range p.zones {
+		vms, err := p.computeSvc.Instances.List(p.project, zone).Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, vm := range vms.Items {
+			all = append(all, ToInstance(vm))
+		}
+	}
+	return all, nil
+}
+
+func (p *Provider) RegisterServiceIdentity(ctx context.Context, name string) (string, error) {
+	accountID := "sa-" + name
+	description := fmt.Sprintf("Service account for the VM %q", name)
+
+	log.Printf("Creating the service account %s", accountID)
+	account, err := p.iamSvc.Projects.ServiceAccounts.Create(
+		"projects/"+p.project,
+		&iam.CreateServiceAccountRequest{
+			AccountId: accountID,
+			ServiceAccount: &iam.ServiceAccount{
+				DisplayName: description,
+			},
+		}).Do()
+	if err != nil {
+		return "", err
+	}
+	return account.Email, nil
+}
+
+func (p *Provider) Create(ctx context.Context, cfg providers.Config) (*providers.Instance, error) {
+	cloudConfig, err := renderCloudConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	emptyForUser := ""
+	metadata := map[string]*string{
+		"user-data":            &cloudConfig,
+		providers.BackendIDKey: &cfg.BackendID,
+		providers.ForUserKey:   &emptyForUser,
+	}
+
+	var scheduling *compute.Scheduling
+	if cfg.Preemptible {
+		scheduling = &compute.Scheduling{
+			Preemptible:       true,
+			AutomaticRestart:  false,
+			OnHostMaintenance: "TERMINATE",
+		}
+	}
+
+	netCfg := utils.NetworkConfig{
+		Network:           cfg.Network,
+		Subnetwork:        cfg.Subnetwork,
+		UseInternalIPOnly: cfg.UseInternalIPOnly,
+	}
+
+	log.Printf("Creating the VM %s/%s/%s", p.project, cfg.Zone, cfg.Name)
+	if err := utils.CreateVM(p.computeSvc, p.project, cfg.Zone, cfg.Name, "User VM", cfg.MachineType, netCfg, cfg.ServiceAccountEmail, cfg.BootDiskSizeGB, scheduling, metadata, pollingInterval); err != nil {
+		return nil, err
+	}
+
+	vm, err := p.computeSvc.Instances.Get(p.project, cfg.Zone, cfg.Name).Do()
+	if err != nil {
+		return nil, err
+	}
+	return ToInstance(vm), nil
+}
+
+func (p *Provider) WaitRunning(ctx context.Context, instance *providers.Instance) (*providers.Instance, error) {
+	for {
+		vm, err := p.computeSvc.Instances.Get(p.project, instance.Zone, instance.Name).Do()
+		if err != nil {
+			return nil, err
+		}
+		if vm.Status == "RUNNING" {
+			return ToInstance(vm), nil
+		}
+		if vm.Status != "PROVISIONING" && vm.Status != "STAGING" {
+			return nil, fmt.Errorf("Unexpected instance status: %q", vm.Status)
+		}
+		time.Sleep(pollingInterval)
+	}
+}
+
+func (p *Provider) SetMetadata(ctx context.Context, instance *providers.Instance, metadata map[string]string) error {
+	vm, err := p.computeSvc.Instances.Get(p.project, instance.Zone, instance.Name).Do()
+	if err != nil {
+		return err
+	}
+
+	merged := make(map[string]string)
+	for k, v := range instance.Metadata {
+		merged[k] = v
+	}
+	for k, v := range metadata {
+		merged[k] = v
+	}
+	var items []*compute.MetadataItems
+	for k, v := range merged {
+		value := v
+		items = append(items, &compute.MetadataItems{Key: k, Value: &value})
+	}
+
+	op, err := p.computeSvc.Instances.SetMetadata(p.project, instance.Zone, instance.Name, &compute.Metadata{
+		Fingerprint: vm.Metadata.Fingerprint,
+		Items:       items,
+	}).Do()
+	if err != nil {
+		return err
+	}
+	if err := utils.WaitForZoneOperation(p.computeSvc, p.project, instance.Zone, op.Name, pollingInterval); err != nil {
+		return err
+	}
+	for k, v := range metadata {
+		instance.Metadata[k] = v
+	}
+	return nil
+}
+
+func (p *Provider) Delete(ctx context.Context, instance *providers.Instance) error {
+	vm, err := p.computeSvc.Instances.Get(p.project, instance.Zone, instance.Name).Do()
+	if err == nil {
+		for _, disk := range vm.Disks {
+			if disk.Boot {
+				continue
+			}
+			log.Printf("Detaching the disk %q from the VM %s/%s/%s", disk.DeviceName, p.project, instance.Zone, instance.Name)
+			op, err := p.computeSvc.Instances.DetachDisk(p.project, instance.Zone, instance.Name, disk.DeviceName).Do()
+			if err != nil {
+				return fmt.Errorf("Failure detaching the disk %q from %q: %q", disk.DeviceName, instance.Name, err.Error())
+			}
+			if err := utils.WaitForZoneOperation(p.computeSvc, p.project, instance.Zone, op.Name, pollingInterval); err != nil {
+				return fmt.Errorf("Failure waiting for a disk detach operation: %q", err.Error())
+			}
+		}
+	}
+
+	log.Printf("Deleting the VM %s/%s/%s", p.project, instance.Zone, instance.Name)
+	op, err := p.computeSvc.Instances.Delete(p.project, instance.Zone, instance.Name).Do()
+	if err != nil {
+		return fmt.Errorf("Failure deleting the instance %q: %q", instance.Name, err.Error())
+	}
+	if err := utils.WaitForZoneOperation(p.computeSvc, p.project, instance.Zone, op.Name, pollingInterval); err != nil {
+		return fmt.Errorf("Failure waiting for an instance delete operation: %q", err.Error())
+	}
+
+	if instance.ServiceAccountEmail != "" {
+		fullAccountName := fmt.Sprintf("projects/%s/serviceAccounts/%s", p.project, instance.ServiceAccountEmail)
+		log.Printf("Deleting the service account %q", fullAccountName)
+		if _, err := p.iamSvc.Projects.ServiceAccounts.Delete(fullAccountName).Do(); err != nil {
+			return fmt.Errorf("Failed to delete the service account %q: %q", fullAccountName, err.Error())
+		}
+	}
+	return nil
+}
+
+func (p *Provider) IsStockoutError(err error) bool {
+	return utils.IsStockoutError(err)
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gce
+
+import (
+	"testing"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestToInstanceRoundTrip(t *testing.T) {
+	backendID := "backend-1"
+	vm := &compute.Instance{
+		Id:                1234,
+		Name:              "test-vm",
+		Zone:              "projects/p/zones/us-central1-a",
+		Status:            "RUNNING",
+		CreationTimestamp: "2020-01-02T03:04:05Z",
+		Metadata: &compute.Metadata{
+			Items: []*compute.MetadataItems{
+				{Key: "backend-id", Value: &backendID},
+			},
+		},
+		Scheduling: &compute.Scheduling{Preemptible: true},
+		ServiceAccounts: []*compute.ServiceAccount{
+			{Email: "sa@p.iam.gserviceaccount.com"},
+		},
+		Disks: []*compute.AttachedDisk{
+			{Boot: true},
+			{Boot: false},
+		},
+	}
+
+	instance := ToInstance(vm)
+
+	if instance.ID != "1234" {
+		t.Errorf("got ID %q, want %q", instance.ID, "1234")
+	}
+	if instance.Zone != "us-central1-a" {
+		t.Errorf("got Zone %q, want %q (the zone path should be trimmed down to its name)", instance.Zone, "us-central1-a")
+	}
+	if got := instance.Metadata["backend-id"]; got != "backend-1" {
+		t.Errorf("got backend-id metadata %q, want %q", got, "backend-1")
+	}
+	if !instance.Preemptible {
+		t.Error("got Preemptible = false, want true")
+	}
+	if instance.ServiceAccountEmail != "sa@p.iam.gserviceaccount.com" {
+		t.Errorf("got ServiceAccountEmail %q, want %q", instance.ServiceAccountEmail, "sa@p.iam.gserviceaccount.com")
+	}
+	if !instance.HasExtraDisk {
+		t.Error("got HasExtraDisk = false, want true for a VM with a non-boot disk attached")
+	}
+	wantCreated := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if !instance.Created.Equal(wantCreated) {
+		t.Errorf("got Created %v, want %v", instance.Created, wantCreated)
+	}
+}
+
+func TestToInstanceNoExtraDisk(t *testing.T) {
+	vm := &compute.Instance{
+		Zone:  "projects/p/zones/us-central1-a",
+		Disks: []*compute.AttachedDisk{{Boot: true}},
+	}
+	if instance := ToInstance(vm); instance.HasExtraDisk {
+		t.Error("got HasExtraDisk = true, want false for a VM with only a boot disk")
+	}
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package openstack implements providers.Provider for OpenStack, using Nova
+// for compute and Cinder for the boot volume.
+package openstack
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/availabilityzones"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/bootfromvolume"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"golang.org/x/net/context"
+
+	"vm-manager/vms/providers"
+)
+
+// Provider implements providers.Provider for OpenStack.
+type Provider struct {
+	computeClient *gophercloud.ServiceClient
+	imageRef      string
+	network       string
+
+	// availabilityZones lists the zones Nova reported as available when
+	// the Provider was constructed. AvailabilityZones returns them so that
+	// callers can place VMs across them via Config.Zone; Create does not
+	// check Config.Zone against this list.
+	availabilityZones []string
+}
+
+// New returns a Provider that manages backend VMs via the given Nova
+// client, booting them from imageRef onto the given network.
+func New(computeClient *gophercloud.ServiceClient, imageRef, network string) (*Provider, error) {
+	azs, err := listAvailabilityZones(computeClient)
+	if err != nil {
+		return nil, err
+	}
+	return &Provider{
+		computeClient:     computeClient,
+		imageRef:          imageRef,
+		network:           network,
+		availabilityZones: azs,
+	}, nil
+}
+
+// listAvailabilityZones returns the names of every availability zone that
+// Nova currently reports as available, mirroring utils.ListZones's
+// healthy-zone filtering for GCE.
+func listAvailabilityZones(client *gophercloud.ServiceClient) ([]string, error) {
+	pages, err := availabilityzones.List(client).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	zoneInfo, err := availabilityzones.ExtractAvailabilityZones(pages)
+	if err != nil {
+		return nil, err
+	}
+	var zones []string
+	for _, z := range zoneInfo {
+		if z.ZoneState.Available {
+			zones = append(zones, z.ZoneName)
+		}
+	}
+	if len(zones) == 0 {
+		return nil, fmt.Errorf("no available Nova availability zones found")
+	}
+	return zones, nil
+}
+
+// AvailabilityZones returns the availability zones this Provider was
+// constructed with, for callers (e.g. vms.Pool) that round-robin across
+// zones themselves.
+func (p *Provider) AvailabilityZones() []string {
+	return p.availabilityZones
+}
+
+func userData(cfg providers.Config) string {
+	agentImage := cfg.AgentImage
+	if agentImage == "" {
+		agentImage = "gcr.io/inverting-proxy/agent"
+	}
+	script := fmt.Sprintf(`#!/bin/bash
+mkdir -p /mnt/disks/user-pd
+mount -o discard,defaults /dev/disk/by-id/virtio-user-pd /mnt/disks/user-pd || true
+docker pull %s
+docker pull %s
+docker run -d --rm --name=backend -p 127.0.0.1:8080:8080 -v /mnt/disks/user-pd:/content --hostname %q %s
+docker run -d --rm --name=agent --net=host --env=BACKEND=%q --env=PROXY=%q %s
+`, agentImage, cfg.ApplicationImage, cfg.ProxiedHostname, cfg.ApplicationImage, cfg.BackendID, cfg.ProxyURL, agentImage)
+	return base64.StdEncoding.EncodeToString([]byte(script))
+}
+
+func (p *Provider) toInstance(server *servers.Server) *providers.Instance {
+	status := "PROVISIONING"
+	switch strings.ToUpper(server.Status) {
+	case "ACTIVE":
+		status = "RUNNING"
+	case "ERROR":
+		status = "ERROR"
+	}
+	return &providers.Instance{
+		ID:       server.ID,
+		Name:     server.Name,
+		Zone:     server.AvailabilityZone,
+		Status:   status,
+		Created:  server.Created,
+		Metadata: server.Metadata,
+	}
+}
+
+func (p *Provider) Create(ctx context.Context, cfg providers.Config) (*providers.Instance, error) {
+	metadata := map[string]string{
+		providers.BackendIDKey: cfg.BackendID,
+		providers.ForUserKey:   "",
+	}
+
+	log.Printf("Creating the VM %q in availability zone %q", cfg.Name, cfg.Zone)
+	server, err := bootfromvolume.Create(p.computeClient, bootfromvolume.CreateOptsExt{
+		CreateOptsBuilder: servers.CreateOpts{
+			Name:             cfg.Name,
+			FlavorName:       cfg.MachineType,
+			AvailabilityZone: cfg.Zone,
+			Networks:         []servers.Network{{UUID: p.network}},
+			Metadata:         metadata,
+			UserData:         []byte(userData(cfg)),
+		},
+		BlockDevice: []bootfromvolume.BlockDevice{
+			{
+				SourceType:          bootfromvolume.SourceImage,
+				UUID:                p.imageRef,
+				DestinationType:     bootfromvolume.DestinationVolume,
+				VolumeSize:          int(cfg.BootDiskSizeGB),
+				DeleteOnTermination: true,
+			},
+		},
+	}).Extract()
+	if err != nil {
+		return nil, err
+	}
+	return p.toInstance(server), nil
+}
+
+func (p *Provider) List(ctx context.Context) ([]*providers.Instance, error) {
+	pages, err := servers.List(p.computeClient, servers.ListOpts{}).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	all, err := servers.ExtractServers(pages)
+	if err != nil {
+		return nil, err
+	}
+	var instances []*providers.Instance
+	for i := range all {
+		instances = append(instances, p.toInstance(&all[i]))
+	}
+	return instances, nil
+}
+
+func (p *Provider) WaitRunning(ctx context.Context, instance *providers.Instance) (*providers.Instance, error) {
+	for {
+		server, err := servers.Get(p.computeClient, instance.ID).Extract()
+		if err != nil {
+			return nil, err
+		}
+		updated := p.toInstance(server)
+		if updated.Status == "RUNNING" {
+			return updated, nil
+		}
+		if updated.Status == "ERROR" {
+			return nil, fmt.Errorf("instance %q entered the ERROR state", instance.Name)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func (p *Provider) SetMetadata(ctx context.Context, instance *providers.Instance, metadata map[string]string) error {
+	if _, err := servers.UpdateMetadata(p.computeClient, instance.ID, servers.MetadataOpts(metadata)).Extract(); err != nil {
+		return err
+	}
+	for k, v := range metadata {
+		instance.Metadata[k] = v
+	}
+	return nil
+}
+
+func (p *Provider) RegisterServiceIdentity(ctx context.Context, name string) (string, error) {
+	// Nova has no per-instance service-account equivalent; workload
+	// identity for OpenStack deployments is handled via project-scoped
+	// application credentials configured on the Provider itself.
+	return "", nil
+}
+
+func (p *Provider) Delete(ctx context.Context, instance *providers.Instance) error {
+	log.Printf("Deleting the VM %q (%s)", instance.Name, instance.ID)
+	return servers.Delete(p.computeClient, instance.ID).ExtractErr()
+}
+
+func (p *Provider) IsStockoutError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(gophercloud.ErrDefault507); ok {
+		return true
+	}
+	return strings.Contains(err.Error(), "No valid host was found")
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package openstack
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+)
+
+func TestToInstanceRoundTrip(t *testing.T) {
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	server := &servers.Server{
+		ID:               "server-1",
+		Name:             "test-vm",
+		Status:           "ACTIVE",
+		Created:          created,
+		AvailabilityZone: "az1",
+		Metadata:         map[string]string{"backend-id": "backend-1"},
+	}
+
+	p := &Provider{}
+	instance := p.toInstance(server)
+
+	if instance.ID != "server-1" {
+		t.Errorf("got ID %q, want %q", instance.ID, "server-1")
+	}
+	if instance.Zone != "az1" {
+		t.Errorf("got Zone %q, want %q", instance.Zone, "az1")
+	}
+	if instance.Status != "RUNNING" {
+		t.Errorf("got Status %q, want %q for an ACTIVE server", instance.Status, "RUNNING")
+	}
+	if !instance.Created.Equal(created) {
+		t.Errorf("got Created %v, want %v", instance.Created, created)
+	}
+	if got := instance.Metadata["backend-id"]; got != "backend-1" {
+		t.Errorf("got backend-id metadata %q, want %q", got, "backend-1")
+	}
+}
+
+func TestToInstanceStatusMapping(t *testing.T) {
+	for _, tc := range []struct {
+		novaStatus string
+		want       string
+	}{
+		{"ACTIVE", "RUNNING"},
+		{"ERROR", "ERROR"},
+		{"BUILD", "PROVISIONING"},
+	} {
+		p := &Provider{}
+		got := p.toInstance(&servers.Server{Status: tc.novaStatus}).Status
+		if got != tc.want {
+			t.Errorf("toInstance status for Nova status %q = %q, want %q", tc.novaStatus, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package providers defines the abstraction that vms.Pool uses to create,
+// list, and tear down backend VMs, so that the pool does not need to be
+// rewritten for every cloud it runs on.
+package providers
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Metadata keys that a Pool and its Provider agree on in order to track
+// which user (if any) a VM is currently assigned to.
+const (
+	BackendIDKey        = "backend-id"
+	ForUserKey          = "for-user"
+	ForUserTimestampKey = "for-user-timestamp"
+)
+
+// Config describes the parameters needed to create a single backend VM,
+// independent of the underlying cloud provider.
+type Config struct {
+	// Name is the name to give the new VM.
+	Name string
+
+	// Zone is the provider-specific zone (or availability zone) to create
+	// the VM in.
+	Zone string
+
+	// ServiceAccountEmail identifies the per-VM service identity created
+	// by a prior call to RegisterServiceIdentity.
+	ServiceAccountEmail string
+
+	MachineType string
+	Network     string
+	Subnetwork  string
+
+	// UseInternalIPOnly, if true, creates the VM without a public IP, so it
+	// is only reachable (and only has egress) via its internal IP on
+	// Network/Subnetwork. This requires Private Google Access (or an
+	// equivalent NAT gateway) to be configured on the subnetwork, and
+	// typically pairs with a non-empty AgentImage pointing at a private
+	// registry mirror the VM can actually reach.
+	UseInternalIPOnly bool
+
+	BootDiskSizeGB int64
+	Preemptible    bool
+
+	// ProxyURL, ApplicationImage, BackendID, and ProxiedHostname are the
+	// application-level bootstrap parameters needed to start the backend
+	// and proxy-agent containers. Each provider encodes these into its own
+	// cloud-specific bootstrap mechanism (e.g. GCE cloud-config user-data,
+	// Azure custom_data, OpenStack user_data).
+	ProxyURL         string
+	ApplicationImage string
+	BackendID        string
+	ProxiedHostname  string
+
+	// AgentImage, if non-empty, overrides the default
+	// "gcr.io/inverting-proxy/agent" image used to start the proxy agent,
+	// e.g. to point at a private registry mirror for UseInternalIPOnly
+	// deployments that have no public egress.
+	AgentImage string
+}
+
+// Instance is a provider-agnostic view of a single backend VM.
+type Instance struct {
+	ID      string
+	Name    string
+	Zone    string
+	Status  string
+	Created time.Time
+
+	// Metadata holds the provider-agnostic key/value pairs set on the VM,
+	// including the BackendIDKey/ForUserKey/ForUserTimestampKey entries
+	// that the Pool uses to track assignment.
+	Metadata map[string]string
+
+	// HasExtraDisk reports whether a disk beyond the boot disk (i.e. a
+	// user's persistent disk) is currently attached to the VM.
+	HasExtraDisk bool
+
+	// Preemptible reports whether this is a preemptible (or equivalent
+	// spot) instance, which the provider may reclaim at any time.
+	Preemptible bool
+
+	// ServiceAccountEmail is the per-VM service identity that was created
+	// for this instance by RegisterServiceIdentity, if any. Provider.Delete
+	// uses it to clean the identity up along with the VM.
+	ServiceAccountEmail string
+}
+
+// Provider abstracts the cloud-specific operations needed to manage a pool
+// of backend VMs, so that vms.Pool can run against GCE, Azure, OpenStack,
+// etc. without being rewritten per cloud.
+type Provider interface {
+	// List returns every backend instance the provider currently knows
+	// about, across all zones it was configured for.
+	List(ctx context.Context) ([]*Instance, error)
+
+	// Create provisions a new backend VM per cfg and returns once the
+	// provider has accepted the request, which may be before the VM has
+	// reached a running state; callers that need to wait for that must
+	// follow up with WaitRunning.
+	Create(ctx context.Context, cfg Config) (*Instance, error)
+
+	// Delete detaches any non-boot disk still attached to instance,
+	// deletes the VM, and releases the service identity (if any) that was
+	// created for it by RegisterServiceIdentity.
+	Delete(ctx context.Context, instance *Instance) error
+
+	// SetMetadata merges the given key/value pairs into instance's
+	// metadata.
+	SetMetadata(ctx context.Context, instance *Instance, metadata map[string]string) error
+
+	// WaitRunning blocks until instance reaches a running state and
+	// returns the up-to-date Instance.
+	WaitRunning(ctx context.Context, instance *Instance) (*Instance, error)
+
+	// RegisterServiceIdentity provisions a dedicated service identity for
+	// a VM named name (e.g. a GCP service account), returning a reference
+	// to pass back in as Config.ServiceAccountEmail.
+	RegisterServiceIdentity(ctx context.Context, name string) (string, error)
+
+	// IsStockoutError reports whether err, as returned from Create,
+	// indicates that the requested zone is out of capacity (as opposed to
+	// some other failure), so that callers know it is worth retrying in a
+	// different zone.
+	IsStockoutError(err error) bool
+}
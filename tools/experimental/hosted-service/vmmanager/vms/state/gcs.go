@@ -0,0 +1,93 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+)
+
+// GCSStore is a StateStore backed by a Google Cloud Storage bucket, used as
+// the durable default so pool state survives a vm-manager restart. Each
+// record is stored as a single JSON object named "<prefix><backendID>.json"
+// in the bucket; GCS object writes and deletes are already atomic and
+// idempotent, which is what lets Put/Delete be safely replayed.
+type GCSStore struct {
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+// NewGCSStore returns a GCSStore that persists records as objects in the
+// given bucket, named with the given prefix (e.g. "vm-manager/pool-state/").
+func NewGCSStore(client *storage.Client, bucket, prefix string) *GCSStore {
+	return &GCSStore{
+		bucket: client.Bucket(bucket),
+		prefix: prefix,
+	}
+}
+
+func (s *GCSStore) objectName(backendID string) string {
+	return s.prefix + backendID + ".json"
+}
+
+func (s *GCSStore) Put(ctx context.Context, rec Record) error {
+	w := s.bucket.Object(s.objectName(rec.BackendID)).NewWriter(ctx)
+	w.ContentType = "application/json"
+	if err := json.NewEncoder(w).Encode(rec); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (s *GCSStore) Delete(ctx context.Context, backendID string) error {
+	err := s.bucket.Object(s.objectName(backendID)).Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	return err
+}
+
+func (s *GCSStore) List(ctx context.Context) ([]Record, error) {
+	var records []Record
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: s.prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed listing pool state objects: %q", err.Error())
+		}
+		r, err := s.bucket.Object(attrs.Name).NewReader(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading pool state object %q: %q", attrs.Name, err.Error())
+		}
+		var rec Record
+		decodeErr := json.NewDecoder(r).Decode(&rec)
+		r.Close()
+		if decodeErr != nil {
+			return nil, fmt.Errorf("failed decoding pool state object %q: %q", attrs.Name, decodeErr.Error())
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
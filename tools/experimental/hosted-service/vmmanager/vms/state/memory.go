@@ -0,0 +1,61 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// InMemoryStore is a StateStore that keeps records in a process-local map.
+// It does not survive a restart, so it is only suitable for tests and for
+// single-process deployments that accept losing pool state across
+// restarts; production deployments should use GCSStore instead.
+type InMemoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+// NewInMemoryStore returns an empty InMemoryStore.
+func NewInMemoryStore() *InMemoryStore {
+	return &InMemoryStore{records: make(map[string]Record)}
+}
+
+func (s *InMemoryStore) Put(ctx context.Context, rec Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[rec.BackendID] = rec
+	return nil
+}
+
+func (s *InMemoryStore) Delete(ctx context.Context, backendID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, backendID)
+	return nil
+}
+
+func (s *InMemoryStore) List(ctx context.Context) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]Record, 0, len(s.records))
+	for _, rec := range s.records {
+		records = append(records, rec)
+	}
+	return records, nil
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestInMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewInMemoryStore()
+
+	records, err := s.List(ctx)
+	if err != nil {
+		t.Fatalf("List on an empty store returned an error: %v", err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("got %d records from an empty store, want 0", len(records))
+	}
+
+	rec := Record{BackendID: "backend-1", Phase: PhaseAssigned, Zone: "us-central1-a", ForUser: "alice@example.com"}
+	if err := s.Put(ctx, rec); err != nil {
+		t.Fatalf("Put returned an error: %v", err)
+	}
+	if records, err := s.List(ctx); err != nil || len(records) != 1 || records[0] != rec {
+		t.Fatalf("List after Put = %v, %v; want [%v], nil", records, err, rec)
+	}
+
+	// Putting a second record for the same BackendID overwrites the first
+	// rather than appending, since replaying the same transition after a
+	// crash must be safe.
+	updated := Record{BackendID: "backend-1", Phase: PhaseFree}
+	if err := s.Put(ctx, updated); err != nil {
+		t.Fatalf("Put (overwrite) returned an error: %v", err)
+	}
+	if records, err := s.List(ctx); err != nil || len(records) != 1 || records[0] != updated {
+		t.Fatalf("List after overwrite = %v, %v; want [%v], nil", records, err, updated)
+	}
+
+	if err := s.Delete(ctx, "backend-1"); err != nil {
+		t.Fatalf("Delete returned an error: %v", err)
+	}
+	if records, err := s.List(ctx); err != nil || len(records) != 0 {
+		t.Fatalf("List after Delete = %v, %v; want [], nil", records, err)
+	}
+
+	// Deleting an already-absent record must be a no-op, not an error, so
+	// that a Pool can safely retry it after a crash.
+	if err := s.Delete(ctx, "backend-1"); err != nil {
+		t.Fatalf("Delete of an absent record returned an error: %v", err)
+	}
+}
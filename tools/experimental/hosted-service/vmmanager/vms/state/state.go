@@ -0,0 +1,77 @@
+/*
+Copyright 2017 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package state defines a StateStore abstraction that a vms.Pool uses to
+// persist what it knows about each pool VM across restarts, so that
+// restarting the manager process does not leak VMs (forgotten forever) or
+// double-count them (re-pushed onto the free VM channel after already being
+// assigned).
+package state
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Phase is the lifecycle phase of a single pool VM, as tracked by a
+// StateStore.
+type Phase string
+
+const (
+	// PhaseFree means the VM was created and is sitting unassigned in the
+	// pool, available to be handed out by Pool.WaitForVM.
+	PhaseFree Phase = "free"
+
+	// PhaseAssigned means the VM has been (or is in the process of being)
+	// handed to ForUser.
+	PhaseAssigned Phase = "assigned"
+)
+
+// Record is the state a StateStore persists for a single pool VM, keyed by
+// BackendID. Writing a Record for a given BackendID is idempotent: a Put
+// simply overwrites whatever was there before, so replaying the same
+// transition after a crash is always safe.
+type Record struct {
+	BackendID string
+	Phase     Phase
+	Zone      string
+
+	// ForUser and AssignedAt are only meaningful when Phase is
+	// PhaseAssigned; they mirror the providers.ForUserKey and
+	// providers.ForUserTimestampKey metadata entries set on the VM itself.
+	ForUser    string
+	AssignedAt time.Time
+}
+
+// StateStore persists the lifecycle state of pool VMs across restarts of
+// the vm-manager process. Implementations must make Put and Delete safe to
+// retry after a failure (e.g. by using the BackendID as the storage key
+// outright, as InMemoryStore and GCSStore both do), since a Pool may write
+// the same Record more than once while recovering from a crash.
+type StateStore interface {
+	// Put persists rec, keyed by rec.BackendID, overwriting any existing
+	// record for that backend.
+	Put(ctx context.Context, rec Record) error
+
+	// Delete removes the record for backendID, if any. Deleting a
+	// backendID with no record is not an error.
+	Delete(ctx context.Context, backendID string) error
+
+	// List returns every record currently persisted, in no particular
+	// order.
+	List(ctx context.Context) ([]Record, error)
+}